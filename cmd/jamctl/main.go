@@ -3,9 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
 	"os"
 	"path/filepath"
 
+	"github.com/edsonmichaque/jam/internal/ipam"
 	"github.com/edsonmichaque/jam/internal/jam"
 )
 
@@ -63,16 +67,39 @@ func main() {
 		config.Jails = make([]string, 0)
 	}
 
-	err = jam.Create(context.Background(), root, &jam.CreateOptions{
+	if len(config.Pools) == 0 {
+		config.Pools = []string{"127.0.1.0/24"}
+	}
+
+	pools := make([]netip.Prefix, 0, len(config.Pools))
+
+	for _, s := range config.Pools {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			panic(err)
+		}
+
+		pools = append(pools, p)
+	}
+
+	addrs, err := ipam.New(jamRoot, pools...)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := addrs.ReserveConfigs(root); err != nil {
+		if !errors.Is(err, ipam.ErrBadConfig) {
+			panic(err)
+		}
+
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	createOpts := &jam.CreateOptions{
 		Name: os.Args[1],
 		Host: &jam.HostOptions{
 			Hostname: "localhost",
 		},
-		IPv4: &jam.IPv4Options{
-			IPOptions: jam.IPOptions{
-				Addr: []string{"127.0.0.1", "127.0.0.2"},
-			},
-		},
 		Path: filepath.Join(jailsPath, os.Args[1]),
 		Exec: &jam.ExecOptions{
 			PreStart: `echo "pre-start"`,
@@ -81,8 +108,17 @@ func main() {
 		},
 		Interface: "em0",
 		Persist:   true,
-	})
-	if err != nil {
+	}
+
+	if err := addrs.Assign(createOpts); err != nil {
+		panic(err)
+	}
+
+	if err := jam.Create(context.Background(), root, createOpts); err != nil {
+		if err := addrs.Release(createOpts.Name); err != nil {
+			panic(err)
+		}
+
 		panic(err)
 	}
 
@@ -99,4 +135,5 @@ func main() {
 
 type Config struct {
 	Jails []string
+	Pools []string `json:",omitempty"`
 }
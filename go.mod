@@ -5,7 +5,10 @@ go 1.20
 require (
 	github.com/dsnet/compress v0.0.1
 	github.com/klauspost/compress v1.17.2
+	github.com/klauspost/pgzip v1.2.6
+	github.com/pierrec/lz4/v4 v4.1.18
 	github.com/ulikunitz/xz v0.5.11
+	golang.org/x/sys v0.12.0
 	google.golang.org/grpc v1.58.2
 	google.golang.org/protobuf v1.31.0
 )
@@ -13,7 +16,6 @@ require (
 require (
 	github.com/golang/protobuf v1.5.3 // indirect
 	golang.org/x/net v0.15.0 // indirect
-	golang.org/x/sys v0.12.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20230920204549-e6e6cdab5c13 // indirect
 )
@@ -0,0 +1,205 @@
+package jam
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// paxACE carries NFSv4 ACLs in the text form libarchive uses: comma
+// separated "tag:perms:flags:type" entries, with user and group entries
+// written as "user:name:perms:flags:type:id". Names are written as ids,
+// since the host's accounts say nothing about those of a jail.
+const paxACE = "SCHILY.acl.ace"
+
+// aclEntry is a single NFSv4 access control entry. Perms and flags use the
+// values of FreeBSD's <sys/acl.h>.
+type aclEntry struct {
+	tag   string
+	id    int
+	perms uint32
+	flags uint32
+	typ   string
+}
+
+type aclBit struct {
+	c   byte
+	bit uint32
+}
+
+// aclPerms and aclFlags are in the order libarchive writes them.
+var (
+	aclPerms = []aclBit{
+		{'r', 0x0008}, // read_data
+		{'w', 0x0010}, // write_data
+		{'x', 0x0001}, // execute
+		{'p', 0x0020}, // append_data
+		{'D', 0x0100}, // delete_child
+		{'d', 0x0800}, // delete
+		{'a', 0x0200}, // read_attributes
+		{'A', 0x0400}, // write_attributes
+		{'R', 0x0040}, // read_xattr
+		{'W', 0x0080}, // write_xattr
+		{'c', 0x1000}, // read_acl
+		{'C', 0x2000}, // write_acl
+		{'o', 0x4000}, // write_owner
+		{'s', 0x8000}, // synchronize
+	}
+
+	aclFlags = []aclBit{
+		{'f', 0x01}, // file_inherit
+		{'d', 0x02}, // dir_inherit
+		{'i', 0x08}, // inherit_only
+		{'n', 0x04}, // no_propagate
+		{'S', 0x10}, // successful_access
+		{'F', 0x20}, // failed_access
+		{'I', 0x80}, // inherited
+	}
+
+	aclTypes = []string{"allow", "deny", "audit", "alarm"}
+)
+
+// trivialACL reports whether entries only restate the file mode, in which
+// case they are not archived.
+func trivialACL(entries []aclEntry) bool {
+	for _, e := range entries {
+		if e.flags != 0 {
+			return false
+		}
+
+		switch e.tag {
+		case "owner@", "group@", "everyone@":
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func formatACL(entries []aclEntry) string {
+	var b strings.Builder
+
+	for i, e := range entries {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		b.WriteString(e.tag)
+
+		if e.tag == "user" || e.tag == "group" {
+			b.WriteString(":" + strconv.Itoa(e.id))
+		}
+
+		b.WriteString(":" + formatACLBits(aclPerms, e.perms))
+		b.WriteString(":" + formatACLBits(aclFlags, e.flags))
+		b.WriteString(":" + e.typ)
+
+		if e.tag == "user" || e.tag == "group" {
+			b.WriteString(":" + strconv.Itoa(e.id))
+		}
+	}
+
+	return b.String()
+}
+
+func formatACLBits(bits []aclBit, v uint32) string {
+	var b []byte
+
+	for _, f := range bits {
+		if v&f.bit != 0 {
+			b = append(b, f.c)
+		}
+	}
+
+	return string(b)
+}
+
+func parseACL(s string) ([]aclEntry, error) {
+	var entries []aclEntry
+
+	for _, text := range strings.Split(s, ",") {
+		fields := strings.Split(strings.TrimSpace(text), ":")
+
+		var e aclEntry
+
+		switch e.tag = fields[0]; e.tag {
+		case "owner@", "group@", "everyone@":
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("invalid ACL entry %q", text)
+			}
+		case "user", "group":
+			if len(fields) != 5 && len(fields) != 6 {
+				return nil, fmt.Errorf("invalid ACL entry %q", text)
+			}
+
+			// The trailing id wins over the name, as in libarchive.
+			id := fields[1]
+			if len(fields) == 6 {
+				id = fields[5]
+			}
+
+			n, err := strconv.Atoi(id)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid ACL id in %q", text)
+			}
+
+			e.id = n
+			fields = fields[1:5]
+		default:
+			return nil, fmt.Errorf("invalid ACL tag in %q", text)
+		}
+
+		var err error
+
+		if e.perms, err = parseACLBits(aclPerms, fields[1]); err != nil {
+			return nil, fmt.Errorf("%w in %q", err, text)
+		}
+
+		if e.flags, err = parseACLBits(aclFlags, fields[2]); err != nil {
+			return nil, fmt.Errorf("%w in %q", err, text)
+		}
+
+		e.typ = fields[3]
+
+		if !validACLType(e.typ) {
+			return nil, fmt.Errorf("invalid ACL type in %q", text)
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func parseACLBits(bits []aclBit, s string) (uint32, error) {
+	var v uint32
+
+next:
+	for i := 0; i < len(s); i++ {
+		if s[i] == '-' {
+			continue
+		}
+
+		for _, f := range bits {
+			if f.c == s[i] {
+				v |= f.bit
+				continue next
+			}
+		}
+
+		return 0, fmt.Errorf("invalid ACL character %q", s[i])
+	}
+
+	return v, nil
+}
+
+func validACLType(typ string) bool {
+	for _, t := range aclTypes {
+		if t == typ {
+			return true
+		}
+	}
+
+	return false
+}
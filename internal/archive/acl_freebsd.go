@@ -0,0 +1,162 @@
+package jam
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// From <sys/acl.h>.
+const (
+	aclTypeNFS4   = 4
+	aclMaxEntries = 254
+)
+
+// aclKernel mirrors struct acl.
+type aclKernel struct {
+	maxcnt  uint32
+	cnt     uint32
+	spare   [4]int32
+	entries [aclMaxEntries]struct {
+		tag   uint32
+		id    uint32
+		perm  uint32
+		typ   uint16
+		flags uint16
+	}
+}
+
+var aclTags = map[uint32]string{
+	0x01: "owner@",
+	0x02: "user",
+	0x04: "group@",
+	0x08: "group",
+	0x40: "everyone@",
+}
+
+var aclEntryTypes = map[uint16]string{
+	0x100: "allow",
+	0x200: "deny",
+	0x400: "audit",
+	0x800: "alarm",
+}
+
+// aclUnsupported reports whether err means the file system has no NFSv4
+// ACLs, or that we may not touch them.
+func aclUnsupported(err error) bool {
+	return errors.Is(err, unix.EINVAL) || xattrUnsupported(err)
+}
+
+// addACL records the NFSv4 ACL of the file at pat, unless it only restates
+// the file mode.
+func addACL(hdr *tar.Header, pat string) error {
+	p, err := unix.BytePtrFromString(pat)
+	if err != nil {
+		return err
+	}
+
+	acl := aclKernel{maxcnt: aclMaxEntries}
+
+	_, _, e := unix.Syscall(unix.SYS___ACL_GET_LINK, uintptr(unsafe.Pointer(p)), aclTypeNFS4, uintptr(unsafe.Pointer(&acl)))
+	if e != 0 {
+		if aclUnsupported(e) {
+			return nil
+		}
+
+		return &fs.PathError{Op: "acl_get_link", Path: pat, Err: e}
+	}
+
+	if acl.cnt > aclMaxEntries {
+		return fmt.Errorf("%s: invalid ACL entry count %d", pat, acl.cnt)
+	}
+
+	entries := make([]aclEntry, 0, acl.cnt)
+
+	for _, ke := range acl.entries[:acl.cnt] {
+		tag, ok := aclTags[ke.tag]
+		if !ok {
+			return fmt.Errorf("%s: unknown ACL tag %#x", pat, ke.tag)
+		}
+
+		typ, ok := aclEntryTypes[ke.typ]
+		if !ok {
+			return fmt.Errorf("%s: unknown ACL entry type %#x", pat, ke.typ)
+		}
+
+		entries = append(entries, aclEntry{
+			tag:   tag,
+			id:    int(ke.id),
+			perms: ke.perm,
+			flags: uint32(ke.flags),
+			typ:   typ,
+		})
+	}
+
+	if trivialACL(entries) {
+		return nil
+	}
+
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+
+	hdr.PAXRecords[paxACE] = formatACL(entries)
+
+	return nil
+}
+
+// setACL restores the NFSv4 ACL of hdr on the open file fd. It has to run
+// after chmod, which rewrites the ACL.
+func setACL(fd int, hdr *tar.Header) error {
+	text, ok := hdr.PAXRecords[paxACE]
+	if !ok {
+		return nil
+	}
+
+	entries, err := parseACL(text)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) > aclMaxEntries {
+		return fmt.Errorf("ACL of %s has more than %d entries", hdr.Name, aclMaxEntries)
+	}
+
+	acl := aclKernel{maxcnt: aclMaxEntries, cnt: uint32(len(entries))}
+
+	for i, e := range entries {
+		ke := &acl.entries[i]
+
+		for tag, name := range aclTags {
+			if name == e.tag {
+				ke.tag = tag
+			}
+		}
+
+		for typ, name := range aclEntryTypes {
+			if name == e.typ {
+				ke.typ = typ
+			}
+		}
+
+		// Entries without a qualifier carry ACL_UNDEFINED_ID.
+		ke.id = ^uint32(0)
+		if e.tag == "user" || e.tag == "group" {
+			ke.id = uint32(e.id)
+		}
+
+		ke.perm = e.perms
+		ke.flags = uint16(e.flags)
+	}
+
+	_, _, e := unix.Syscall(unix.SYS___ACL_SET_FD, uintptr(fd), aclTypeNFS4, uintptr(unsafe.Pointer(&acl)))
+	if e != 0 && !aclUnsupported(e) {
+		return e
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+package jam
+
+import "archive/tar"
+
+// addACL does nothing on Linux, where POSIX ACLs travel as extended
+// attributes and NFSv4 ACLs are not exposed.
+func addACL(*tar.Header, string) error {
+	return nil
+}
+
+func setACL(int, *tar.Header) error {
+	return nil
+}
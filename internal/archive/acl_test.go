@@ -0,0 +1,65 @@
+package jam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestACLText(t *testing.T) {
+	entries := []aclEntry{
+		{tag: "owner@", perms: 0x0008 | 0x0010 | 0x0001, typ: "allow"},
+		{tag: "user", id: 1001, perms: 0x0008 | 0x1000, flags: 0x01 | 0x02, typ: "allow"},
+		{tag: "group", id: 20, perms: 0x0010, typ: "deny"},
+		{tag: "everyone@", perms: 0x0008, flags: 0x80, typ: "allow"},
+	}
+
+	const text = "owner@:rwx::allow,user:1001:rc:fd:allow:1001,group:20:w::deny:20,everyone@:r:I:allow"
+
+	if got := formatACL(entries); got != text {
+		t.Errorf("formatACL() = %q, want %q", got, text)
+	}
+
+	got, err := parseACL(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("parseACL() = %+v, want %+v", got, entries)
+	}
+
+	// libarchive's long form pads with dashes and may name the user.
+	got, err = parseACL("user:alice:r-----------c--:f------:allow:1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (aclEntry{tag: "user", id: 1001, perms: 0x0008 | 0x1000, flags: 0x01, typ: "allow"}); got[0] != want {
+		t.Errorf("parseACL() = %+v, want %+v", got[0], want)
+	}
+
+	for _, bad := range []string{"", "owner@:rwx:allow", "nobody@:r::allow", "owner@:q::allow", "owner@:r::permit", "user:alice:r::allow"} {
+		if _, err := parseACL(bad); err == nil {
+			t.Errorf("parseACL(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestTrivialACL(t *testing.T) {
+	trivial := []aclEntry{
+		{tag: "owner@", perms: 0x0008, typ: "allow"},
+		{tag: "everyone@", perms: 0x0008, typ: "allow"},
+	}
+
+	if !trivialACL(trivial) {
+		t.Error("mode-only ACL is not trivial")
+	}
+
+	if trivialACL(append(trivial, aclEntry{tag: "user", id: 1, typ: "allow"})) {
+		t.Error("ACL with a user entry is trivial")
+	}
+
+	if trivialACL([]aclEntry{{tag: "owner@", flags: 0x02, typ: "allow"}}) {
+		t.Error("inheritable ACL is trivial")
+	}
+}
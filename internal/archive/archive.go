@@ -1,14 +1,25 @@
 package jam
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/dsnet/compress/bzip2"
+	jail "github.com/edsonmichaque/jam/internal/jam"
+	"github.com/klauspost/compress/s2"
 	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4/v4"
 	"github.com/ulikunitz/xz"
 )
 
@@ -20,6 +31,8 @@ const (
 	ArchiveBzip2
 	ArchiveXz
 	ArchiveZStd
+	ArchiveLZ4
+	ArchiveS2
 )
 
 const (
@@ -28,62 +41,231 @@ const (
 
 type (
 	TarOptions struct {
+		// UseCLI delegates to bsdtar(1), run through Runner.
 		UseCLI bool
+		Runner jail.Runner
+
+		// MaxFiles and MaxBytes bound what UntarStream extracts. Zero
+		// selects DefaultMaxFiles and DefaultMaxBytes, a negative value
+		// disables the limit. bsdtar cannot enforce them: with UseCLI no
+		// limit applies and setting one is an error.
+		MaxFiles int
+		MaxBytes int64
+
+		// Manifest, when set, is filled by Tar with an entry for every
+		// member. EmbedManifest also appends it to the archive as
+		// ManifestName.
+		Manifest      *Manifest
+		EmbedManifest bool
+
+		// Verify checks extracted members against a manifest obtained
+		// out of band; VerifyEmbedded against the one in the archive.
+		Verify         *Manifest
+		VerifyEmbedded bool
+
+		// Base makes Tar write a delta against an earlier Manifest,
+		// which UntarStream replays onto the base tree with ApplyDelta.
+		Base       *Manifest
+		ApplyDelta bool
+
+		// Progress, when set, is called as data moves. BytesIn counts
+		// file contents for Tar and archive bytes for UntarStream.
+		// SizeHint is reported as the estimated total. Without it, Tar
+		// walks src up front to size the files it will read, while
+		// UntarStream and bsdtar leave Total at 0.
+		Progress ProgressFunc
+		SizeHint int64
+
+		// VerifyOptions is checked by UntarStream.
+		VerifyOptions
 	}
 
 	ArchiveOptions struct {
 		Mode ArchiveMode
+
+		// Level is the compression level, 0 selecting the default of
+		// the mode: 1-9 for gzip, bzip2 and lz4, 1-22 for zstd and 1-3
+		// for s2.
+		Level int
+
+		// WindowSize is the zstd window size, a power of two.
+		WindowSize int
+
+		// Concurrency is the number of blocks compressed in parallel by
+		// gzip, zstd, lz4 and s2.
+		Concurrency int
+
+		// DictSize is the xz dictionary size in bytes.
+		DictSize int
+
+		// Digest, when set, receives the digest of the compressed
+		// archive. ExpectedDigest makes unarchiving fail with
+		// ErrDigestMismatch if the input does not match.
+		Digest         *Digest
+		ExpectedDigest Digest
+
+		// SigningKey signs the digest of the archive being written and
+		// the signature is stored in Signature. ArchiveWithOptions also
+		// writes it next to the destination.
+		SigningKey ed25519.PrivateKey
+
+		// VerifyOptions is checked when unarchiving.
+		VerifyOptions
+
+		// Progress, when set, is called as data moves, with SizeHint as
+		// the estimated size of the source.
+		Progress ProgressFunc
+		SizeHint int64
 	}
 
+	// UnarchiveFunc and ArchiveFunc wrap a stream in a decompressor or
+	// compressor. The streams they are given already fail once the
+	// context is done.
 	UnarchiveFunc func(context.Context, io.Reader) (io.ReadCloser, error)
 
-	ArchiveFunc func(context.Context, io.Writer) (io.Writer, error)
+	ArchiveFunc func(context.Context, io.Writer) (io.WriteCloser, error)
 )
 
-func Tar(_ io.Reader, _ string, opts *TarOptions) error {
-	if opts == nil {
-		opts = &TarOptions{
-			UseCLI: false,
-		}
+var ErrUnknownFormat = errors.New("unknown archive format")
+
+// ustarOffset is where the "ustar" magic sits in a tar header block.
+const ustarOffset = 257
+
+var magics = []struct {
+	mode  ArchiveMode
+	magic []byte
+}{
+	{ArchiveGZip, []byte{0x1f, 0x8b}},
+	{ArchiveBzip2, []byte("BZh")},
+	{ArchiveXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{ArchiveZStd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{ArchiveLZ4, []byte{0x04, 0x22, 0x4d, 0x18}},
+	{ArchiveS2, []byte("\xff\x06\x00\x00S2sTwO")},
+	// S2 readers also decode Snappy framed streams.
+	{ArchiveS2, []byte("\xff\x06\x00\x00sNaPpY")},
+}
+
+// findArchiveMode sniffs the compression of the stream buffered in br
+// without consuming any of it.
+func findArchiveMode(br *bufio.Reader) (ArchiveMode, error) {
+	b, err := br.Peek(ustarOffset + 5)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return 0, err
 	}
 
-	if opts.UseCLI {
+	for _, m := range magics {
+		if bytes.HasPrefix(b, m.magic) {
+			return m.mode, nil
+		}
 	}
 
-	return nil
-}
+	if len(b) >= ustarOffset+5 && string(b[ustarOffset:ustarOffset+5]) == "ustar" {
+		return NopArchive, nil
+	}
 
-func UntarStream(r io.Reader, dest string, opts *TarOptions) error {
-	return errors.New("not implemented")
+	return 0, ErrUnknownFormat
 }
 
-func findArchiveMode(ctx context.Context, r io.Reader) (ArchiveMode, error) {
-	return 0, errors.New("not implemented")
-}
+// UnarchiveStream decompresses r into dst like UnarchiveStreamWithOptions,
+// detecting the compression from the leading bytes of r instead of using
+// opts.Mode. Uncompressed tar streams are copied unchanged.
+func UnarchiveStream(ctx context.Context, r io.Reader, dst io.Writer, opts *ArchiveOptions) error {
+	br := bufio.NewReader(r)
 
-func unarchiveStream(ctx context.Context, r io.Reader, dst io.Writer) error {
-	mode, err := findArchiveMode(ctx, r)
+	mode, err := findArchiveMode(br)
 	if err != nil {
 		return err
 	}
 
-	opts := ArchiveOptions{
-		Mode: mode,
+	var o ArchiveOptions
+	if opts != nil {
+		o = *opts
 	}
 
-	return UnarchiveStreamWithOptions(ctx, r, dst, &opts)
+	o.Mode = mode
+
+	return UnarchiveStreamWithOptions(ctx, br, dst, &o)
 }
 
+// UnarchiveWithOptions decompresses r into the file dest, which is only
+// replaced once the whole archive has been read.
 func UnarchiveWithOptions(ctx context.Context, r io.Reader, dest string, opts *ArchiveOptions) error {
-	f, err := os.Open(dest)
+	return createAtomic(dest, func(w io.Writer) error {
+		return UnarchiveStreamWithOptions(ctx, r, w, opts)
+	})
+}
+
+// UnarchiveFile decompresses the archive at src into dest. Unless
+// opts.Signature is set, the signature is read from the file next to src.
+func UnarchiveFile(ctx context.Context, src, dest string, opts *ArchiveOptions) error {
+	var o ArchiveOptions
+	if opts != nil {
+		o = *opts
+	}
+
+	if len(o.Signature) == 0 && !o.AllowUnsigned {
+		sig, err := ReadSignature(src)
+		if err != nil {
+			return err
+		}
+
+		o.Signature = sig
+	}
+
+	f, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 
-	return UnarchiveStreamWithOptions(ctx, r, f, opts)
+	defer f.Close()
+
+	return UnarchiveWithOptions(ctx, f, dest, &o)
 }
 
+// UnarchiveStreamWithOptions decompresses src into dest. The signature of
+// src is checked first, as described by VerifyOptions. It stops with the
+// context's error as soon as ctx is done.
 func UnarchiveStreamWithOptions(ctx context.Context, src io.Reader, dest io.Writer, opts *ArchiveOptions) error {
+	if opts == nil {
+		opts = &ArchiveOptions{
+			Mode: NopArchive,
+		}
+	}
+
+	p := newProgress(opts.Progress, opts.SizeHint)
+
+	src = &reader{ctx: ctx, r: src, p: p}
+	dest = &writer{ctx: ctx, w: dest, p: p}
+
+	var err error
+
+	if opts.AllowUnsigned {
+		err = unarchiveStream(ctx, src, dest, opts)
+	} else {
+		err = unarchiveSigned(ctx, src, dest, opts)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	p.report()
+
+	return nil
+}
+
+func unarchiveStream(ctx context.Context, src io.Reader, dest io.Writer, opts *ArchiveOptions) error {
+	var h hash.Hash
+
+	if opts != nil && opts.ExpectedDigest != "" {
+		if err := opts.ExpectedDigest.Validate(); err != nil {
+			return err
+		}
+
+		h = sha256.New()
+		src = io.TeeReader(src, h)
+	}
+
 	unarchive := buildUnarchiveFunc(opts)
 
 	r, err := unarchive(ctx, src)
@@ -92,12 +274,52 @@ func UnarchiveStreamWithOptions(ctx context.Context, src io.Reader, dest io.Writ
 	}
 
 	if _, err := io.Copy(dest, r); err != nil {
+		r.Close()
 		return err
 	}
 
+	if err := r.Close(); err != nil {
+		return err
+	}
+
+	if h == nil {
+		return nil
+	}
+
+	// Decompressors may stop short of trailing bytes, which still count
+	// towards the digest.
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return err
+	}
+
+	if got := newDigest(h); got != opts.ExpectedDigest {
+		return fmt.Errorf("%w: got %s, want %s", ErrDigestMismatch, got, opts.ExpectedDigest)
+	}
+
 	return nil
 }
 
+// unarchiveSigned checks the signature over the digest of src before
+// anything is decompressed.
+func unarchiveSigned(ctx context.Context, src io.Reader, dest io.Writer, opts *ArchiveOptions) error {
+	f, digest, err := opts.verify(src)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if opts.ExpectedDigest != "" && digest != opts.ExpectedDigest {
+		return fmt.Errorf("%w: got %s, want %s", ErrDigestMismatch, digest, opts.ExpectedDigest)
+	}
+
+	o := *opts
+	o.ExpectedDigest = ""
+
+	// Only the spooling counts towards BytesIn.
+	return unarchiveStream(ctx, &reader{ctx: ctx, r: f}, dest, &o)
+}
+
 func buildUnarchiveFunc(opts *ArchiveOptions) UnarchiveFunc {
 	if opts == nil {
 		opts = &ArchiveOptions{
@@ -112,8 +334,12 @@ func buildUnarchiveFunc(opts *ArchiveOptions) UnarchiveFunc {
 		return bzip2Unarchiver
 	case ArchiveXz:
 		return xzUnarchiver
-	case Zstd:
+	case ArchiveZStd:
 		return zstdUnarchiver
+	case ArchiveLZ4:
+		return lz4Unarchiver
+	case ArchiveS2:
+		return s2Unarchiver
 	default:
 		return nopUnarchiver
 	}
@@ -146,19 +372,94 @@ func zstdUnarchiver(_ context.Context, src io.Reader) (io.ReadCloser, error) {
 		return nil, err
 	}
 
-	return io.NopCloser(r), nil
+	return r.IOReadCloser(), nil
+}
+
+func lz4Unarchiver(_ context.Context, src io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(lz4.NewReader(src)), nil
+}
+
+func s2Unarchiver(_ context.Context, src io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(s2.NewReader(src)), nil
 }
 
 func ArchiveWithOptions(ctx context.Context, src io.Reader, dest string, opts *ArchiveOptions) error {
-	f, err := os.Open(dest)
+	err := createAtomic(dest, func(w io.Writer) error {
+		return ArchiveStreamWithOptions(ctx, src, w, opts)
+	})
+	if err != nil || opts == nil || opts.SigningKey == nil {
+		return err
+	}
+
+	// An archive without its signature cannot be imported, so do not
+	// leave one behind.
+	if err := writeSignature(dest, opts.Signature); err != nil {
+		os.Remove(dest)
+		return err
+	}
+
+	return nil
+}
+
+// createAtomic writes dest through a temporary file in the same directory
+// that is renamed into place only once write succeeds, so readers never see
+// a partial file.
+func createAtomic(dest string, write func(io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+
+	err = write(f)
+	if err == nil {
+		err = f.Chmod(0o644)
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+
 	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
 
-	return ArchiveStreamWithOptions(ctx, src, f, opts)
+	return nil
 }
 
+// ArchiveStreamWithOptions compresses src into dst. It stops with the
+// context's error as soon as ctx is done.
 func ArchiveStreamWithOptions(ctx context.Context, src io.Reader, dst io.Writer, opts *ArchiveOptions) error {
+	var p *progress
+
+	if opts != nil {
+		if err := opts.validate(); err != nil {
+			return err
+		}
+
+		p = newProgress(opts.Progress, opts.SizeHint)
+	}
+
+	src = &reader{ctx: ctx, r: src, p: p}
+	dst = &writer{ctx: ctx, w: dst, p: p}
+
+	var h hash.Hash
+
+	if opts != nil && (opts.Digest != nil || opts.SigningKey != nil) {
+		h = sha256.New()
+		dst = io.MultiWriter(dst, h)
+	}
+
 	archive := buildArchiveFunc(opts)
 
 	w, err := archive(ctx, dst)
@@ -167,9 +468,32 @@ func ArchiveStreamWithOptions(ctx context.Context, src io.Reader, dst io.Writer,
 	}
 
 	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+
+	// Closing flushes the compressor's trailer into dst; dst itself
+	// belongs to the caller.
+	if err := w.Close(); err != nil {
 		return err
 	}
 
+	p.report()
+
+	if h == nil {
+		return nil
+	}
+
+	digest := newDigest(h)
+
+	if opts.Digest != nil {
+		*opts.Digest = digest
+	}
+
+	if opts.SigningKey != nil {
+		opts.Signature = Sign(opts.SigningKey, digest)
+	}
+
 	return nil
 }
 
@@ -182,34 +506,126 @@ func buildArchiveFunc(opts *ArchiveOptions) ArchiveFunc {
 
 	switch opts.Mode {
 	case ArchiveGZip:
-		return gzipArchiver
+		return gzipArchiver(opts)
 	case ArchiveBzip2:
-		return bzip2Archiver
+		return bzip2Archiver(opts)
 	case ArchiveXz:
-		return xzArchiver
-	case Zstd:
-		return zstdArchiver
+		return xzArchiver(opts)
+	case ArchiveZStd:
+		return zstdArchiver(opts)
+	case ArchiveLZ4:
+		return lz4Archiver(opts)
+	case ArchiveS2:
+		return s2Archiver(opts)
 	default:
 		return nopArchiver
 	}
 }
 
-func nopArchiver(_ context.Context, src io.Writer) (io.Writer, error) {
-	return src, nil
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func nopArchiver(_ context.Context, src io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{src}, nil
+}
+
+func gzipArchiver(opts *ArchiveOptions) ArchiveFunc {
+	level := opts.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	return func(_ context.Context, src io.Writer) (io.WriteCloser, error) {
+		if opts.Concurrency <= 1 {
+			return gzip.NewWriterLevel(src, level)
+		}
+
+		w, err := pgzip.NewWriterLevel(src, level)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := w.SetConcurrency(pgzipBlockSize, opts.Concurrency); err != nil {
+			return nil, err
+		}
+
+		return w, nil
+	}
+}
+
+func bzip2Archiver(opts *ArchiveOptions) ArchiveFunc {
+	return func(_ context.Context, src io.Writer) (io.WriteCloser, error) {
+		return bzip2.NewWriter(src, &bzip2.WriterConfig{Level: opts.Level})
+	}
 }
 
-func gzipArchiver(_ context.Context, src io.Writer) (io.Writer, error) {
-	return gzip.NewWriter(src), nil
+func xzArchiver(opts *ArchiveOptions) ArchiveFunc {
+	return func(_ context.Context, src io.Writer) (io.WriteCloser, error) {
+		return xz.WriterConfig{DictCap: opts.DictSize}.NewWriter(src)
+	}
 }
 
-func bzip2Archiver(_ context.Context, src io.Writer) (io.Writer, error) {
-	return bzip2.NewWriter(src, nil)
+func zstdArchiver(opts *ArchiveOptions) ArchiveFunc {
+	var encOpts []zstd.EOption
+
+	if opts.Level != 0 {
+		encOpts = append(encOpts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.Level)))
+	}
+
+	if opts.WindowSize != 0 {
+		encOpts = append(encOpts, zstd.WithWindowSize(opts.WindowSize))
+	}
+
+	if opts.Concurrency != 0 {
+		encOpts = append(encOpts, zstd.WithEncoderConcurrency(opts.Concurrency))
+	}
+
+	return func(_ context.Context, src io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(src, encOpts...)
+	}
 }
 
-func xzArchiver(_ context.Context, src io.Writer) (io.Writer, error) {
-	return xz.NewWriter(src)
+func lz4Archiver(opts *ArchiveOptions) ArchiveFunc {
+	var lzOpts []lz4.Option
+
+	if opts.Level != 0 {
+		lzOpts = append(lzOpts, lz4.CompressionLevelOption(lz4.CompressionLevel(1<<(8+opts.Level))))
+	}
+
+	if opts.Concurrency != 0 {
+		lzOpts = append(lzOpts, lz4.ConcurrencyOption(opts.Concurrency))
+	}
+
+	return func(_ context.Context, src io.Writer) (io.WriteCloser, error) {
+		w := lz4.NewWriter(src)
+		if err := w.Apply(lzOpts...); err != nil {
+			return nil, err
+		}
+
+		return w, nil
+	}
 }
 
-func zstdArchiver(_ context.Context, src io.Writer) (io.Writer, error) {
-	return zstd.NewWriter(src)
+func s2Archiver(opts *ArchiveOptions) ArchiveFunc {
+	var s2Opts []s2.WriterOption
+
+	switch opts.Level {
+	case 2:
+		s2Opts = append(s2Opts, s2.WriterBetterCompression())
+	case 3:
+		s2Opts = append(s2Opts, s2.WriterBestCompression())
+	}
+
+	if opts.Concurrency != 0 {
+		s2Opts = append(s2Opts, s2.WriterConcurrency(opts.Concurrency))
+	}
+
+	return func(_ context.Context, src io.Writer) (io.WriteCloser, error) {
+		return s2.NewWriter(src, s2Opts...), nil
+	}
 }
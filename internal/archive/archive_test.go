@@ -0,0 +1,170 @@
+package jam
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPayload returns a tar stream a few compressor blocks long, mixing
+// compressible and random data.
+func testPayload(t *testing.T) []byte {
+	t.Helper()
+
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 1<<20)
+	rnd.Read(random)
+
+	return buildTar(t,
+		fileEntry("zeros", string(make([]byte, 3<<20))),
+		fileEntry("random", string(random)),
+		fileEntry("text", string(bytes.Repeat([]byte("jail archive\n"), 1<<16))),
+	).Bytes()
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	payload := testPayload(t)
+
+	tests := []struct {
+		name string
+		opts ArchiveOptions
+	}{
+		{"none", ArchiveOptions{Mode: NopArchive}},
+		{"gzip", ArchiveOptions{Mode: ArchiveGZip}},
+		{"gzip level", ArchiveOptions{Mode: ArchiveGZip, Level: 9}},
+		{"gzip concurrency", ArchiveOptions{Mode: ArchiveGZip, Concurrency: 4}},
+		{"bzip2", ArchiveOptions{Mode: ArchiveBzip2}},
+		{"bzip2 level", ArchiveOptions{Mode: ArchiveBzip2, Level: 1}},
+		{"xz", ArchiveOptions{Mode: ArchiveXz}},
+		{"xz dictionary", ArchiveOptions{Mode: ArchiveXz, DictSize: 1 << 16}},
+		{"zstd", ArchiveOptions{Mode: ArchiveZStd}},
+		{"zstd level and window", ArchiveOptions{Mode: ArchiveZStd, Level: 19, WindowSize: 1 << 20}},
+		{"zstd concurrency", ArchiveOptions{Mode: ArchiveZStd, Concurrency: 4}},
+		{"lz4", ArchiveOptions{Mode: ArchiveLZ4}},
+		{"lz4 level", ArchiveOptions{Mode: ArchiveLZ4, Level: 9}},
+		{"lz4 concurrency", ArchiveOptions{Mode: ArchiveLZ4, Concurrency: 4}},
+		{"s2", ArchiveOptions{Mode: ArchiveS2}},
+		{"s2 level", ArchiveOptions{Mode: ArchiveS2, Level: 3}},
+		{"s2 concurrency", ArchiveOptions{Mode: ArchiveS2, Concurrency: 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var archived bytes.Buffer
+
+			opts := tt.opts
+			if err := ArchiveStreamWithOptions(context.Background(), bytes.NewReader(payload), &archived, &opts); err != nil {
+				t.Fatal(err)
+			}
+
+			mode, err := findArchiveMode(bufio.NewReader(bytes.NewReader(archived.Bytes())))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if mode != tt.opts.Mode {
+				t.Errorf("detected mode %d, want %d", mode, tt.opts.Mode)
+			}
+
+			unsigned := &ArchiveOptions{Mode: tt.opts.Mode}
+			unsigned.AllowUnsigned = true
+
+			var out bytes.Buffer
+
+			if err := UnarchiveStreamWithOptions(context.Background(), bytes.NewReader(archived.Bytes()), &out, unsigned); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(out.Bytes(), payload) {
+				t.Fatal("UnarchiveStreamWithOptions() output differs from the input")
+			}
+
+			out.Reset()
+
+			if err := UnarchiveStream(context.Background(), bytes.NewReader(archived.Bytes()), &out, unsigned); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(out.Bytes(), payload) {
+				t.Fatal("UnarchiveStream() output differs from the input")
+			}
+		})
+	}
+}
+
+func TestArchiveWithOptionsDigest(t *testing.T) {
+	payload := testPayload(t)
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "base.tar.zst")
+
+	var digest Digest
+
+	opts := &ArchiveOptions{Mode: ArchiveZStd, Concurrency: 2, Digest: &digest}
+	if err := ArchiveWithOptions(context.Background(), bytes.NewReader(payload), dest, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "base.tar")
+
+	uopts := &ArchiveOptions{Mode: ArchiveZStd, ExpectedDigest: digest}
+	uopts.AllowUnsigned = true
+
+	f, err := os.Open(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	if err := UnarchiveWithOptions(context.Background(), f, out, uopts); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, payload) {
+		t.Error("UnarchiveWithOptions() output differs from the input")
+	}
+
+	uopts.ExpectedDigest = Digest("sha256:" + strings.Repeat("0", 64))
+
+	if err := UnarchiveFile(context.Background(), dest, out, uopts); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("UnarchiveFile() error = %v, want %v", err, ErrDigestMismatch)
+	}
+}
+
+func TestArchiveOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts ArchiveOptions
+	}{
+		{"level without compression", ArchiveOptions{Mode: NopArchive, Level: 1}},
+		{"bzip2 concurrency", ArchiveOptions{Mode: ArchiveBzip2, Concurrency: 2}},
+		{"xz level", ArchiveOptions{Mode: ArchiveXz, Level: 6}},
+		{"xz dictionary too small", ArchiveOptions{Mode: ArchiveXz, DictSize: 1}},
+		{"zstd window not a power of two", ArchiveOptions{Mode: ArchiveZStd, WindowSize: 3 << 20}},
+		{"lz4 level", ArchiveOptions{Mode: ArchiveLZ4, Level: 10}},
+		{"s2 level", ArchiveOptions{Mode: ArchiveS2, Level: 4}},
+		{"s2 window", ArchiveOptions{Mode: ArchiveS2, WindowSize: 1 << 20}},
+		{"negative concurrency", ArchiveOptions{Mode: ArchiveGZip, Concurrency: -1}},
+		{"unknown mode", ArchiveOptions{Mode: ArchiveMode(99)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ArchiveStreamWithOptions(context.Background(), bytes.NewReader(nil), &bytes.Buffer{}, &tt.opts)
+			if !errors.Is(err, ErrInvalidOption) {
+				t.Fatalf("error = %v, want %v", err, ErrInvalidOption)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package jam
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// whiteoutPrefix marks a delta member recording the deletion of the file
+// named by the rest of its base name, as in OCI image layers.
+const whiteoutPrefix = ".wh."
+
+// unchanged reports whether hdr describes the same file as e, judging by
+// metadata only so that unchanged contents are never read.
+func (e *ManifestEntry) unchanged(hdr *tar.Header) bool {
+	n := newManifestEntry(hdr, "")
+
+	return e.Type == n.Type && e.Size == n.Size && e.ModTime.Equal(n.ModTime) &&
+		e.Mode == n.Mode && e.Uid == n.Uid && e.Gid == n.Gid && e.Linkname == n.Linkname
+}
+
+// writeWhiteouts records the members of base missing from seen, which maps
+// the names found in the tree to their type. Deleting a directory, or
+// replacing it with another type of file, deletes its contents, so those
+// get no whiteout of their own.
+func writeWhiteouts(tw *tar.Writer, base *Manifest, seen map[string]string) error {
+	deleted := make(map[string]bool)
+
+	for _, e := range base.Entries {
+		if deleted[path.Dir(e.Name)] {
+			deleted[e.Name] = true
+			continue
+		}
+
+		if typ, ok := seen[e.Name]; e.Name == "." || ok {
+			deleted[e.Name] = e.Type == "dir" && typ != "dir"
+			continue
+		}
+
+		deleted[e.Name] = true
+
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(path.Dir(e.Name), whiteoutPrefix+path.Base(e.Name)),
+			ModTime:  time.Unix(0, 0),
+			Format:   tar.FormatPAX,
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// errWhiteoutName is returned by Tar for files that would read back as
+// whiteouts.
+var errWhiteoutName = errors.New("file name is reserved for whiteouts")
+
+func isWhiteout(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeReg && strings.HasPrefix(path.Base(hdr.Name), whiteoutPrefix)
+}
+
+// whiteout deletes the file a whiteout member refers to, along with its
+// contents if it is a directory.
+func (r *root) whiteout(hdr *tar.Header) error {
+	comps, err := splitName(hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	if len(comps) == 0 {
+		return fmt.Errorf("%w: %q", ErrUnsafePath, hdr.Name)
+	}
+
+	last := len(comps) - 1
+
+	target := strings.TrimPrefix(comps[last], whiteoutPrefix)
+	if target == "" || target == "." || target == ".." {
+		return fmt.Errorf("%w: whiteout %q", ErrUnsafePath, hdr.Name)
+	}
+
+	comps[last] = target
+
+	dirfd, name, err := r.lookup(comps)
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(dirfd)
+
+	return removeAll(dirfd, name)
+}
+
+// removeAll removes name under dirfd without following symlinks.
+func removeAll(dirfd int, name string) error {
+	clearFileFlags(dirfd, name)
+
+	err := unix.Unlinkat(dirfd, name, 0)
+	if err == nil || errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+
+	if !errors.Is(err, unix.EISDIR) && !errors.Is(err, unix.EPERM) {
+		return err
+	}
+
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	dir := os.NewFile(uintptr(fd), name)
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range names {
+		if err := removeAll(fd, n); err != nil {
+			return err
+		}
+	}
+
+	return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+}
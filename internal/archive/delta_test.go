@@ -0,0 +1,103 @@
+package jam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeltaRejectsWhiteoutNames(t *testing.T) {
+	src := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(src, ".wh.f"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	err := Tar(context.Background(), &buf, src, &TarOptions{Base: &Manifest{}})
+	if !errors.Is(err, errWhiteoutName) {
+		t.Fatalf("Tar() error = %v, want %v", err, errWhiteoutName)
+	}
+}
+
+func TestWhiteoutDoesNotCreateDirectories(t *testing.T) {
+	dest := t.TempDir()
+
+	opts := &TarOptions{ApplyDelta: true}
+	opts.AllowUnsigned = true
+
+	if err := UntarStream(context.Background(), buildTar(t, fileEntry("a/b/.wh.c", "")), dest, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, "a")); !os.IsNotExist(err) {
+		t.Errorf("whiteout created its parent: %v", err)
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	src := t.TempDir()
+
+	for _, name := range []string{"keep", "gone", "changed"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		full     bytes.Buffer
+		manifest Manifest
+	)
+
+	if err := Tar(context.Background(), &full, src, &TarOptions{Manifest: &manifest}); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+
+	if err := UntarStream(context.Background(), &full, dest, unsigned); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(src, "gone")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(src, "changed"), []byte("changed again"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var delta bytes.Buffer
+
+	if err := Tar(context.Background(), &delta, src, &TarOptions{Base: &manifest}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &TarOptions{ApplyDelta: true}
+	opts.AllowUnsigned = true
+
+	if err := UntarStream(context.Background(), &delta, dest, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, "gone")); !os.IsNotExist(err) {
+		t.Errorf("gone was not deleted: %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dest, "changed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "changed again" {
+		t.Errorf("changed = %q, want %q", b, "changed again")
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, "keep")); err != nil {
+		t.Error(err)
+	}
+}
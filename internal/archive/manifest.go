@@ -0,0 +1,235 @@
+package jam
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ManifestName is the name of the manifest entry Tar appends to the archive
+// when TarOptions.EmbedManifest is set.
+const ManifestName = ".jam-manifest.json"
+
+var (
+	ErrManifestMismatch = errors.New("archive does not match manifest")
+	ErrDigestMismatch   = errors.New("archive digest mismatch")
+)
+
+// ManifestEntry describes a single archive member. SHA256 is only set for
+// regular files.
+type ManifestEntry struct {
+	Name     string    `json:"Name"`
+	Type     string    `json:"Type"`
+	Mode     int64     `json:"Mode"`
+	Uid      int       `json:"Uid"`
+	Gid      int       `json:"Gid"`
+	Size     int64     `json:"Size"`
+	ModTime  time.Time `json:"ModTime"`
+	Linkname string    `json:"Linkname,omitempty"`
+	SHA256   string    `json:"SHA256,omitempty"`
+}
+
+// Manifest lists the members of a tar archive in archive order.
+type Manifest struct {
+	Entries []ManifestEntry `json:"Entries"`
+}
+
+func (m *Manifest) index() map[string]*ManifestEntry {
+	idx := make(map[string]*ManifestEntry, len(m.Entries))
+
+	for i := range m.Entries {
+		idx[m.Entries[i].Name] = &m.Entries[i]
+	}
+
+	return idx
+}
+
+var entryTypes = map[byte]string{
+	tar.TypeReg:     "file",
+	tar.TypeRegA:    "file",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "link",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// manifestName maps a member name to its manifest form: cleaned, without
+// a leading "./" or trailing slash, and "." for the root.
+func manifestName(name string) string {
+	return strings.TrimPrefix(path.Clean("./"+name), "./")
+}
+
+func newManifestEntry(hdr *tar.Header, sum string) ManifestEntry {
+	typ, ok := entryTypes[hdr.Typeflag]
+	if !ok {
+		typ = string(hdr.Typeflag)
+	}
+
+	e := ManifestEntry{
+		Name:    manifestName(hdr.Name),
+		Type:    typ,
+		Mode:    hdr.Mode,
+		Uid:     hdr.Uid,
+		Gid:     hdr.Gid,
+		Size:    hdr.Size,
+		ModTime: hdr.ModTime.UTC(),
+		SHA256:  sum,
+	}
+
+	if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+		e.Linkname = hdr.Linkname
+	}
+
+	return e
+}
+
+// matches compares everything but the modification time, which says
+// nothing about the integrity of the contents.
+func (e *ManifestEntry) matches(o *ManifestEntry) bool {
+	return e.Type == o.Type && e.Mode == o.Mode && e.Uid == o.Uid && e.Gid == o.Gid &&
+		e.Size == o.Size && e.Linkname == o.Linkname && e.SHA256 == o.SHA256
+}
+
+func writeManifest(tw *tar.Writer, m *Manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ManifestName,
+		Mode:     0o644,
+		Size:     int64(len(b)),
+		ModTime:  time.Now(),
+		Format:   tar.FormatPAX,
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err = tw.Write(b)
+
+	return err
+}
+
+// verifier checks extracted entries against an expected manifest, given up
+// front or found embedded at the end of the archive.
+type verifier struct {
+	expected map[string]*ManifestEntry
+	seen     Manifest
+	names    map[string]bool
+}
+
+func newVerifier(m *Manifest) *verifier {
+	v := &verifier{names: make(map[string]bool)}
+
+	if m != nil {
+		v.expected = m.index()
+	}
+
+	return v
+}
+
+// check records e and, when the manifest is already known, fails as soon
+// as e is unknown or differs from it. A name showing up twice fails too,
+// as the later entry would replace what was checked before.
+func (v *verifier) check(e ManifestEntry) error {
+	if v.names[e.Name] {
+		return fmt.Errorf("%w: duplicate entry %q", ErrManifestMismatch, e.Name)
+	}
+
+	v.names[e.Name] = true
+	v.seen.Entries = append(v.seen.Entries, e)
+
+	if v.expected == nil {
+		return nil
+	}
+
+	want, ok := v.expected[e.Name]
+	if !ok {
+		return fmt.Errorf("%w: unexpected entry %q", ErrManifestMismatch, e.Name)
+	}
+
+	if !want.matches(&e) {
+		return fmt.Errorf("%w: entry %q differs", ErrManifestMismatch, e.Name)
+	}
+
+	return nil
+}
+
+// embedded reads the manifest carried by the archive. Without a manifest
+// given up front, the entries seen so far are checked against it.
+func (v *verifier) embedded(r io.Reader) error {
+	var m Manifest
+
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return fmt.Errorf("%w: %v", ErrManifestMismatch, err)
+	}
+
+	if v.expected != nil {
+		return nil
+	}
+
+	v.expected = m.index()
+
+	for _, e := range v.seen.Entries {
+		want, ok := v.expected[e.Name]
+		if !ok || !want.matches(&e) {
+			return fmt.Errorf("%w: entry %q differs", ErrManifestMismatch, e.Name)
+		}
+	}
+
+	return nil
+}
+
+// finish fails if entries of the expected manifest never showed up.
+func (v *verifier) finish() error {
+	if v.expected == nil {
+		return nil
+	}
+
+	for name := range v.expected {
+		if !v.names[name] {
+			return fmt.Errorf("%w: missing entry %q", ErrManifestMismatch, name)
+		}
+	}
+
+	return nil
+}
+
+// Digest identifies archive contents in the form "sha256:<hex>".
+type Digest string
+
+func newDigest(h hash.Hash) Digest {
+	return Digest("sha256:" + hex.EncodeToString(h.Sum(nil)))
+}
+
+func hexSum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Validate checks that d is a well-formed SHA-256 digest.
+func (d Digest) Validate() error {
+	sum, ok := strings.CutPrefix(string(d), "sha256:")
+	if !ok || len(sum) != 2*sha256.Size {
+		return fmt.Errorf("invalid digest %q", string(d))
+	}
+
+	if _, err := hex.DecodeString(sum); err != nil {
+		return fmt.Errorf("invalid digest %q", string(d))
+	}
+
+	return nil
+}
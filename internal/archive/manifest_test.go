@@ -0,0 +1,133 @@
+package jam
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbeddedManifest(t *testing.T) {
+	src := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(src, "f"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	if err := Tar(context.Background(), &buf, src, &TarOptions{EmbedManifest: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(buf.Bytes(), []byte(`"Name":"f"`)) {
+		t.Error("embedded manifest does not use the Name key")
+	}
+
+	dest := t.TempDir()
+
+	if err := UntarStream(context.Background(), &buf, dest, &TarOptions{VerifyEmbedded: true, VerifyOptions: unsigned.VerifyOptions}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, ManifestName)); !os.IsNotExist(err) {
+		t.Errorf("manifest was extracted: %v", err)
+	}
+}
+
+func TestManifestNameIsOrdinaryFile(t *testing.T) {
+	src := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(src, ManifestName), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	if err := Tar(context.Background(), &buf, src, &TarOptions{EmbedManifest: true}); err == nil {
+		t.Error("Tar() with EmbedManifest accepted a tree holding the manifest name")
+	}
+
+	buf.Reset()
+
+	if err := Tar(context.Background(), &buf, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+
+	if err := UntarStream(context.Background(), &buf, dest, unsigned); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dest, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "data" {
+		t.Errorf("%s = %q, want %q", ManifestName, b, "data")
+	}
+}
+
+func TestVerifyManifest(t *testing.T) {
+	sum := sha256.Sum256([]byte("x"))
+
+	want := &Manifest{}
+	for _, e := range []entry{dirEntry("./", 0o755), fileEntry("a", "x"), fileEntry("b", "x")} {
+		hdr := e.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Mode, hdr.Size = 0o644, int64(len(e.body))
+			want.Entries = append(want.Entries, newManifestEntry(&hdr, hex.EncodeToString(sum[:])))
+		} else {
+			want.Entries = append(want.Entries, newManifestEntry(&hdr, ""))
+		}
+	}
+
+	tests := []struct {
+		name    string
+		entries []entry
+		err     error
+	}{
+		{
+			name:    "match",
+			entries: []entry{dirEntry("./", 0o755), fileEntry("a", "x"), fileEntry("b", "x")},
+		},
+		{
+			name:    "missing",
+			entries: []entry{dirEntry("./", 0o755), fileEntry("a", "x")},
+			err:     ErrManifestMismatch,
+		},
+		{
+			name:    "duplicate hiding a missing entry",
+			entries: []entry{dirEntry("./", 0o755), fileEntry("a", "x"), fileEntry("a", "x")},
+			err:     ErrManifestMismatch,
+		},
+		{
+			name:    "unexpected",
+			entries: []entry{dirEntry("./", 0o755), fileEntry("a", "x"), fileEntry("c", "x")},
+			err:     ErrManifestMismatch,
+		},
+		{
+			name:    "differs",
+			entries: []entry{dirEntry("./", 0o755), fileEntry("a", "x"), fileEntry("b", "y")},
+			err:     ErrManifestMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &TarOptions{Verify: want, VerifyOptions: unsigned.VerifyOptions}
+
+			err := UntarStream(context.Background(), buildTar(t, tt.entries...), t.TempDir(), opts)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("UntarStream() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
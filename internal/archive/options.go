@@ -0,0 +1,114 @@
+package jam
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// pgzipBlockSize is the amount of input compressed per gzip block when
+	// Concurrency is set.
+	pgzipBlockSize = 1 << 20
+
+	minDictSize = 1 << 12
+	maxDictSize = 1<<32 - 1
+)
+
+var ErrInvalidOption = errors.New("invalid archive option")
+
+// validate checks that every option set is supported by the mode and
+// within its range.
+func (o *ArchiveOptions) validate() error {
+	if o.Level < 0 || o.WindowSize < 0 || o.Concurrency < 0 || o.DictSize < 0 {
+		return fmt.Errorf("%w: negative value", ErrInvalidOption)
+	}
+
+	if o.SigningKey != nil && len(o.SigningKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%w: signing key must be %d bytes", ErrInvalidOption, ed25519.PrivateKeySize)
+	}
+
+	switch o.Mode {
+	case NopArchive:
+		return o.unsupported("uncompressed", o.Level, o.WindowSize, o.Concurrency, o.DictSize)
+	case ArchiveGZip:
+		if err := o.unsupported("gzip", 0, o.WindowSize, 0, o.DictSize); err != nil {
+			return err
+		}
+
+		return checkLevel("gzip", o.Level, 9)
+	case ArchiveBzip2:
+		if err := o.unsupported("bzip2", 0, o.WindowSize, o.Concurrency, o.DictSize); err != nil {
+			return err
+		}
+
+		return checkLevel("bzip2", o.Level, 9)
+	case ArchiveXz:
+		if err := o.unsupported("xz", o.Level, o.WindowSize, o.Concurrency, 0); err != nil {
+			return err
+		}
+
+		if o.DictSize != 0 && (o.DictSize < minDictSize || int64(o.DictSize) > maxDictSize) {
+			return fmt.Errorf("%w: xz dictionary size must be between %d and %d", ErrInvalidOption, minDictSize, int64(maxDictSize))
+		}
+	case ArchiveZStd:
+		if err := o.unsupported("zstd", 0, 0, 0, o.DictSize); err != nil {
+			return err
+		}
+
+		if err := checkLevel("zstd", o.Level, 22); err != nil {
+			return err
+		}
+
+		if w := o.WindowSize; w != 0 && (w < zstd.MinWindowSize || w > zstd.MaxWindowSize || bits.OnesCount(uint(w)) != 1) {
+			return fmt.Errorf("%w: zstd window size must be a power of two between %d and %d", ErrInvalidOption, zstd.MinWindowSize, zstd.MaxWindowSize)
+		}
+	case ArchiveLZ4:
+		if err := o.unsupported("lz4", 0, o.WindowSize, 0, o.DictSize); err != nil {
+			return err
+		}
+
+		return checkLevel("lz4", o.Level, 9)
+	case ArchiveS2:
+		if err := o.unsupported("s2", 0, o.WindowSize, 0, o.DictSize); err != nil {
+			return err
+		}
+
+		return checkLevel("s2", o.Level, 3)
+	default:
+		return fmt.Errorf("%w: unknown mode %d", ErrInvalidOption, o.Mode)
+	}
+
+	return nil
+}
+
+// unsupported reports the first of level, window size, concurrency and
+// dictionary size that is set although the mode has no use for it.
+func (o *ArchiveOptions) unsupported(mode string, level, window, concurrency, dict int) error {
+	for _, opt := range []struct {
+		name string
+		v    int
+	}{
+		{"level", level},
+		{"window size", window},
+		{"concurrency", concurrency},
+		{"dictionary size", dict},
+	} {
+		if opt.v != 0 {
+			return fmt.Errorf("%w: %s does not support the %s option", ErrInvalidOption, mode, opt.name)
+		}
+	}
+
+	return nil
+}
+
+func checkLevel(mode string, level, max int) error {
+	if level > max {
+		return fmt.Errorf("%w: %s level must be between 1 and %d", ErrInvalidOption, mode, max)
+	}
+
+	return nil
+}
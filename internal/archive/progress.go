@@ -0,0 +1,128 @@
+package jam
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// progressInterval is the amount of data moved between two progress
+// reports.
+const progressInterval = 1 << 20
+
+// Progress is a snapshot of a running operation. BytesIn counts what was
+// read from the source, BytesOut what was written to the destination and
+// Total is the expected BytesIn at completion, 0 if unknown.
+type Progress struct {
+	BytesIn  int64
+	BytesOut int64
+	Entries  int64
+	Total    int64
+}
+
+// ProgressFunc receives progress reports. Compressors may write from their
+// own goroutines, but calls are never concurrent.
+type ProgressFunc func(Progress)
+
+// progress accumulates counters and reports them every progressInterval
+// bytes. A nil *progress ignores everything.
+type progress struct {
+	fn    ProgressFunc
+	total int64
+
+	in, out, entries atomic.Int64
+	last             atomic.Int64
+
+	mu sync.Mutex
+}
+
+func newProgress(fn ProgressFunc, total int64) *progress {
+	if fn == nil {
+		return nil
+	}
+
+	return &progress{fn: fn, total: total}
+}
+
+func (p *progress) addIn(n int64) {
+	if p != nil {
+		p.in.Add(n)
+		p.maybeReport()
+	}
+}
+
+func (p *progress) addOut(n int64) {
+	if p != nil {
+		p.out.Add(n)
+		p.maybeReport()
+	}
+}
+
+func (p *progress) addEntry() {
+	if p != nil {
+		p.entries.Add(1)
+	}
+}
+
+func (p *progress) maybeReport() {
+	moved := p.in.Load() + p.out.Load()
+
+	if last := p.last.Load(); moved-last >= progressInterval && p.last.CompareAndSwap(last, moved) {
+		p.report()
+	}
+}
+
+// report calls the callback with the current counters.
+func (p *progress) report() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.fn(Progress{
+		BytesIn:  p.in.Load(),
+		BytesOut: p.out.Load(),
+		Entries:  p.entries.Load(),
+		Total:    p.total,
+	})
+}
+
+// reader stops with the context's error once ctx is done and counts what
+// it reads.
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	p   *progress
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := r.r.Read(b)
+	r.p.addIn(int64(n))
+
+	return n, err
+}
+
+// writer is the io.Writer counterpart of reader.
+type writer struct {
+	ctx context.Context
+	w   io.Writer
+	p   *progress
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := w.w.Write(b)
+	w.p.addOut(int64(n))
+
+	return n, err
+}
@@ -0,0 +1,154 @@
+package jam
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTarProgressTotal(t *testing.T) {
+	src := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(src, "a"), bytes.Repeat([]byte{'a'}, 3000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(src, "b"), bytes.Repeat([]byte{'b'}, 5000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hardlinks are only read once.
+	if err := os.Link(filepath.Join(src, "b"), filepath.Join(src, "c")); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		last     Progress
+		manifest Manifest
+	)
+
+	opts := &TarOptions{
+		Manifest: &manifest,
+		Progress: func(p Progress) { last = p },
+	}
+
+	if err := Tar(context.Background(), &bytes.Buffer{}, src, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if last.Total != 8000 || last.BytesIn != last.Total {
+		t.Errorf("Total = %d, BytesIn = %d, want 8000", last.Total, last.BytesIn)
+	}
+
+	if err := os.WriteFile(filepath.Join(src, "a"), bytes.Repeat([]byte{'a'}, 4000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A delta only reads what changed.
+	opts = &TarOptions{
+		Base:     &manifest,
+		Progress: func(p Progress) { last = p },
+	}
+
+	if err := Tar(context.Background(), &bytes.Buffer{}, src, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if last.Total != 4000 || last.BytesIn != last.Total {
+		t.Errorf("delta Total = %d, BytesIn = %d, want 4000", last.Total, last.BytesIn)
+	}
+
+	opts = &TarOptions{
+		SizeHint: 42,
+		Progress: func(p Progress) { last = p },
+	}
+
+	if err := Tar(context.Background(), &bytes.Buffer{}, src, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if last.Total != 42 {
+		t.Errorf("Total = %d, want the SizeHint 42", last.Total)
+	}
+}
+
+// cancelAfter returns a ProgressFunc cancelling ctx once n bytes moved, and
+// a counter of the reports made after that.
+func cancelAfter(cancel context.CancelFunc, n int64) (ProgressFunc, *int) {
+	var (
+		cancelled bool
+		late      int
+	)
+
+	return func(p Progress) {
+		if cancelled {
+			late++
+			return
+		}
+
+		if p.BytesIn+p.BytesOut >= n {
+			cancelled = true
+			cancel()
+		}
+	}, &late
+}
+
+func TestTarCancel(t *testing.T) {
+	src := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(src, "big"), bytes.Repeat([]byte{'b'}, 8<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fn, late := cancelAfter(cancel, 2<<20)
+
+	var buf bytes.Buffer
+
+	if err := Tar(ctx, &buf, src, &TarOptions{Progress: fn}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Tar() error = %v, want %v", err, context.Canceled)
+	}
+
+	if *late != 0 {
+		t.Errorf("%d progress reports after cancellation", *late)
+	}
+
+	if buf.Len() >= 8<<20 {
+		t.Errorf("Tar() wrote %d bytes after cancellation", buf.Len())
+	}
+}
+
+func TestUntarStreamCancel(t *testing.T) {
+	buf := buildTar(t,
+		fileEntry("small", "s"),
+		fileEntry("big", strings.Repeat("b", 8<<20)),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fn, late := cancelAfter(cancel, 2<<20)
+
+	opts := &TarOptions{Progress: fn}
+	opts.AllowUnsigned = true
+
+	dest := t.TempDir()
+
+	if err := UntarStream(ctx, buf, dest, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("UntarStream() error = %v, want %v", err, context.Canceled)
+	}
+
+	if *late != 0 {
+		t.Errorf("%d progress reports after cancellation", *late)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dest, "big")); !os.IsNotExist(err) {
+		t.Errorf("partially extracted file left behind: %v", err)
+	}
+}
@@ -0,0 +1,452 @@
+package jam
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var ErrUnsafePath = errors.New("unsafe path in archive")
+
+// root performs every filesystem operation of an extraction relative to a
+// directory descriptor. Each path component is opened with O_NOFOLLOW, so
+// neither ".." nor symlinks planted by earlier entries can lead outside of
+// the destination.
+type root struct {
+	fd int
+
+	// replace lets entries replace existing files of another type,
+	// removing non-empty directories.
+	replace bool
+}
+
+func openRoot(dest string) (*root, error) {
+	fd, err := unix.Open(dest, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: dest, Err: err}
+	}
+
+	return &root{fd: fd}, nil
+}
+
+func (r *root) Close() error {
+	return unix.Close(r.fd)
+}
+
+// splitName validates an archive member name and returns its components.
+// Absolute names and names with ".." components are rejected. The archive
+// root itself yields no components.
+func splitName(name string) ([]string, error) {
+	if strings.HasPrefix(name, "/") || strings.ContainsRune(name, 0) {
+		return nil, fmt.Errorf("%w: %q", ErrUnsafePath, name)
+	}
+
+	var comps []string
+
+	for _, c := range strings.Split(name, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			return nil, fmt.Errorf("%w: %q", ErrUnsafePath, name)
+		default:
+			comps = append(comps, c)
+		}
+	}
+
+	return comps, nil
+}
+
+// checkSymlink rejects relative link targets that climb above the root.
+// Absolute targets are left alone: they are meaningful inside the jail and
+// are never followed during extraction.
+func checkSymlink(name, target string) error {
+	if target == "" {
+		return fmt.Errorf("%w: empty symlink target for %q", ErrUnsafePath, name)
+	}
+
+	if path.IsAbs(target) {
+		return nil
+	}
+
+	resolved := path.Join(path.Dir(strings.TrimSuffix(name, "/")), target)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("%w: symlink %q points outside the destination", ErrUnsafePath, name)
+	}
+
+	return nil
+}
+
+// parent returns a descriptor for the directory holding comps, creating
+// missing directories on the way, and the final component. For the root
+// itself it returns a duplicate of the root descriptor and ".".
+func (r *root) parent(comps []string) (int, string, error) {
+	return r.walk(comps, true)
+}
+
+// lookup is parent without creating anything; a missing directory fails
+// with ENOENT.
+func (r *root) lookup(comps []string) (int, string, error) {
+	return r.walk(comps, false)
+}
+
+func (r *root) walk(comps []string, create bool) (int, string, error) {
+	fd, err := unix.Dup(r.fd)
+	if err != nil {
+		return -1, "", err
+	}
+
+	if len(comps) == 0 {
+		return fd, ".", nil
+	}
+
+	for _, c := range comps[:len(comps)-1] {
+		next, err := unix.Openat(fd, c, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if create && errors.Is(err, unix.ENOENT) {
+			if err = unix.Mkdirat(fd, c, 0o755); err == nil || errors.Is(err, unix.EEXIST) {
+				next, err = unix.Openat(fd, c, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			}
+		}
+
+		unix.Close(fd)
+
+		if err != nil {
+			if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.EMLINK) || errors.Is(err, unix.ENOTDIR) {
+				return -1, "", fmt.Errorf("%w: %q traverses a symlink or file", ErrUnsafePath, strings.Join(comps, "/"))
+			}
+
+			return -1, "", err
+		}
+
+		fd = next
+	}
+
+	return fd, comps[len(comps)-1], nil
+}
+
+// removeExisting removes whatever is at name so that a new entry can be created in
+// its place. Empty directories are removed too; non-empty ones are kept
+// when keepDir is set. File flags are cleared first, even on a kept
+// directory, as they would prevent changing it.
+func (r *root) removeExisting(dirfd int, name string, keepDir bool) error {
+	var st unix.Stat_t
+
+	if err := unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+
+		return err
+	}
+
+	clearFileFlags(dirfd, name)
+
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		if keepDir {
+			return nil
+		}
+
+		if r.replace {
+			return removeAll(dirfd, name)
+		}
+
+		return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+	}
+
+	return unix.Unlinkat(dirfd, name, 0)
+}
+
+func (r *root) extract(rd io.Reader, hdr *tar.Header) error {
+	comps, err := splitName(hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	if len(comps) == 0 && hdr.Typeflag != tar.TypeDir {
+		return fmt.Errorf("%w: %q is not a directory", ErrUnsafePath, hdr.Name)
+	}
+
+	dirfd, name, err := r.parent(comps)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(dirfd)
+
+	if len(comps) > 0 {
+		if err := r.removeExisting(dirfd, name, hdr.Typeflag == tar.TypeDir); err != nil {
+			return err
+		}
+	}
+
+	mode := uint32(hdr.FileInfo().Mode().Perm())
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if len(comps) == 0 {
+			return nil
+		}
+
+		if err := unix.Mkdirat(dirfd, name, 0o700); err != nil && !errors.Is(err, unix.EEXIST) {
+			return err
+		}
+
+		return nil
+	case tar.TypeReg, tar.TypeRegA:
+		fd, err := unix.Openat(dirfd, name, unix.O_CREAT|unix.O_EXCL|unix.O_WRONLY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0o600)
+		if err != nil {
+			return err
+		}
+
+		f := os.NewFile(uintptr(fd), hdr.Name)
+
+		if isSparse(hdr) {
+			err = copySparse(f, rd, hdr.Size)
+		} else {
+			_, err = io.Copy(f, rd)
+		}
+
+		if err != nil {
+			// Do not leave a truncated file behind, e.g. on cancellation.
+			f.Close()
+			unix.Unlinkat(dirfd, name, 0)
+
+			return err
+		}
+
+		return f.Close()
+	case tar.TypeSymlink:
+		if err := checkSymlink(hdr.Name, hdr.Linkname); err != nil {
+			return err
+		}
+
+		return unix.Symlinkat(hdr.Linkname, dirfd, name)
+	case tar.TypeLink:
+		return r.link(hdr.Linkname, dirfd, name)
+	case tar.TypeChar:
+		return mknodat(dirfd, name, unix.S_IFCHR|mode, uint32(hdr.Devmajor), uint32(hdr.Devminor))
+	case tar.TypeBlock:
+		return mknodat(dirfd, name, unix.S_IFBLK|mode, uint32(hdr.Devmajor), uint32(hdr.Devminor))
+	case tar.TypeFifo:
+		return mknodat(dirfd, name, unix.S_IFIFO|mode, 0, 0)
+	default:
+		return nil
+	}
+}
+
+// link creates a hardlink to an entry already extracted under the root.
+func (r *root) link(target string, dirfd int, name string) error {
+	comps, err := splitName(target)
+	if err != nil || len(comps) == 0 {
+		return fmt.Errorf("%w: hardlink to %q", ErrUnsafePath, target)
+	}
+
+	// The target has to be an earlier entry; looking it up must not
+	// create its directories.
+	srcfd, srcName, err := r.lookup(comps)
+	if err != nil {
+		return fmt.Errorf("hardlink to %q: %w", target, err)
+	}
+
+	defer unix.Close(srcfd)
+
+	var st unix.Stat_t
+
+	if err := unix.Fstatat(srcfd, srcName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("hardlink to %q: %w", target, err)
+	}
+
+	if st.Mode&unix.S_IFMT == unix.S_IFDIR {
+		return fmt.Errorf("%w: hardlink to directory %q", ErrUnsafePath, target)
+	}
+
+	return unix.Linkat(srcfd, srcName, dirfd, name, 0)
+}
+
+// fileTypes maps the tar entry types to the file type they extract to.
+var fileTypes = map[byte]uint32{
+	tar.TypeDir:     unix.S_IFDIR,
+	tar.TypeReg:     unix.S_IFREG,
+	tar.TypeRegA:    unix.S_IFREG,
+	tar.TypeSymlink: unix.S_IFLNK,
+	tar.TypeChar:    unix.S_IFCHR,
+	tar.TypeBlock:   unix.S_IFBLK,
+	tar.TypeFifo:    unix.S_IFIFO,
+}
+
+// setMetadata applies the ownership, mode, times, extended attributes and
+// ACLs of hdr. It runs after the whole archive has been extracted, so
+// a later entry may have replaced hdr.Name with something else, typically a
+// symlink pointing out of the root; entries whose type no longer matches
+// the header are rejected.
+func (r *root) setMetadata(hdr *tar.Header) error {
+	typ, ok := fileTypes[hdr.Typeflag]
+	if !ok {
+		return nil
+	}
+
+	comps, err := splitName(hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	dirfd, name, err := r.parent(comps)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(dirfd)
+
+	fd := -1
+
+	switch typ {
+	case unix.S_IFDIR, unix.S_IFREG, unix.S_IFIFO:
+		// O_NONBLOCK keeps the open of a fifo from waiting for a writer.
+		fd, err = unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+		if err != nil {
+			if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.EMLINK) {
+				return fmt.Errorf("%w: %q was replaced by a symlink", ErrUnsafePath, hdr.Name)
+			}
+
+			return err
+		}
+
+		defer unix.Close(fd)
+	}
+
+	var st unix.Stat_t
+
+	if fd >= 0 {
+		err = unix.Fstat(fd, &st)
+	} else {
+		// Device nodes are not opened, and symlinks cannot be. The *at
+		// calls below do not follow symlinks, except for chmod, which
+		// is only reached once the type has been checked.
+		err = unix.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if uint32(st.Mode)&unix.S_IFMT != typ {
+		return fmt.Errorf("%w: %q changed type during extraction", ErrUnsafePath, hdr.Name)
+	}
+
+	// chown clears the set-id bits, so it has to come before chmod.
+	if os.Geteuid() == 0 {
+		if fd >= 0 {
+			err = unix.Fchown(fd, hdr.Uid, hdr.Gid)
+		} else {
+			err = unix.Fchownat(dirfd, name, hdr.Uid, hdr.Gid, unix.AT_SYMLINK_NOFOLLOW)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if typ == unix.S_IFDIR || typ == unix.S_IFREG {
+		// Set before chmod, which may leave the file unwritable.
+		if err := setXattrs(fd, hdr); err != nil {
+			return err
+		}
+	}
+
+	if typ != unix.S_IFLNK {
+		mode := hdr.FileInfo().Mode()
+		perm := uint32(mode.Perm())
+
+		if mode&fs.ModeSetuid != 0 {
+			perm |= unix.S_ISUID
+		}
+
+		if mode&fs.ModeSetgid != 0 {
+			perm |= unix.S_ISGID
+		}
+
+		if mode&fs.ModeSticky != 0 {
+			perm |= unix.S_ISVTX
+		}
+
+		if fd >= 0 {
+			err = unix.Fchmod(fd, perm)
+		} else {
+			err = unix.Fchmodat(dirfd, name, perm, 0)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if typ == unix.S_IFDIR || typ == unix.S_IFREG {
+		// chmod rewrites NFSv4 ACLs, so they come after it.
+		if err := setACL(fd, hdr); err != nil {
+			return err
+		}
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(hdr.ModTime.UnixNano()),
+	}
+
+	return unix.UtimesNanoAt(dirfd, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// setFlags applies the file flags of hdr. Flags such as schg forbid
+// linking to, replacing and changing the metadata of a file, so they are
+// set once everything else is done.
+func (r *root) setFlags(hdr *tar.Header) error {
+	flags := hdr.PAXRecords[paxFFlags]
+	if flags == "" || (hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) {
+		return nil
+	}
+
+	comps, err := splitName(hdr.Name)
+	if err != nil {
+		return err
+	}
+
+	dirfd, name, err := r.lookup(comps)
+	if err != nil {
+		return err
+	}
+
+	defer unix.Close(dirfd)
+
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, unix.ELOOP) || errors.Is(err, unix.EMLINK) {
+			return fmt.Errorf("%w: %q was replaced by a symlink", ErrUnsafePath, hdr.Name)
+		}
+
+		return err
+	}
+
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+
+	if uint32(st.Mode)&unix.S_IFMT != fileTypes[hdr.Typeflag] {
+		return fmt.Errorf("%w: %q changed type during extraction", ErrUnsafePath, hdr.Name)
+	}
+
+	return setFileFlags(fd, flags)
+}
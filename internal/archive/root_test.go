@@ -0,0 +1,313 @@
+package jam
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+type entry struct {
+	hdr  tar.Header
+	body string
+}
+
+func buildTar(t *testing.T, entries ...entry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	tw := tar.NewWriter(&buf)
+
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+		}
+
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+		}
+
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+func dirEntry(name string, mode int64) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: mode}}
+}
+
+func fileEntry(name, body string) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name}, body: body}
+}
+
+func symlinkEntry(name, target string) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target}}
+}
+
+func hardlinkEntry(name, target string) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: target}}
+}
+
+var unsigned = &TarOptions{VerifyOptions: VerifyOptions{AllowUnsigned: true}}
+
+func TestUntarStreamRejectsMaliciousArchives(t *testing.T) {
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "victim")
+
+	tests := []struct {
+		name    string
+		entries func() []entry
+		opts    TarOptions
+		err     error
+	}{
+		{
+			name:    "dot dot",
+			entries: func() []entry { return []entry{fileEntry("../victim", "x")} },
+			err:     ErrUnsafePath,
+		},
+		{
+			name:    "nested dot dot",
+			entries: func() []entry { return []entry{dirEntry("a/", 0o755), fileEntry("a/../../victim", "x")} },
+			err:     ErrUnsafePath,
+		},
+		{
+			name:    "absolute name",
+			entries: func() []entry { return []entry{fileEntry(victim, "x")} },
+			err:     ErrUnsafePath,
+		},
+		{
+			name:    "relative symlink escape",
+			entries: func() []entry { return []entry{symlinkEntry("l", "../../victim")} },
+			err:     ErrUnsafePath,
+		},
+		{
+			name: "write through symlink",
+			entries: func() []entry {
+				return []entry{symlinkEntry("l", outside), fileEntry("l/victim", "x")}
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "chmod through symlink replacing a directory",
+			entries: func() []entry {
+				return []entry{dirEntry("d/", 0o777), symlinkEntry("d", victim)}
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "chmod through symlink replacing a nested directory",
+			entries: func() []entry {
+				return []entry{dirEntry("d/", 0o755), dirEntry("d/e/", 0o777), symlinkEntry("d/e", victim)}
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name:    "hardlink dot dot",
+			entries: func() []entry { return []entry{hardlinkEntry("h", "../victim")} },
+			err:     ErrUnsafePath,
+		},
+		{
+			name:    "hardlink absolute",
+			entries: func() []entry { return []entry{hardlinkEntry("h", victim)} },
+			err:     ErrUnsafePath,
+		},
+		{
+			name: "hardlink through symlink",
+			entries: func() []entry {
+				return []entry{symlinkEntry("l", outside), hardlinkEntry("h", "l/victim")}
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "too many files",
+			entries: func() []entry {
+				return []entry{fileEntry("a", ""), fileEntry("b", ""), fileEntry("c", "")}
+			},
+			opts: TarOptions{MaxFiles: 2},
+			err:  ErrLimitExceeded,
+		},
+		{
+			name: "too many bytes",
+			entries: func() []entry {
+				return []entry{fileEntry("a", strings.Repeat("x", 64)), fileEntry("b", strings.Repeat("x", 64))}
+			},
+			opts: TarOptions{MaxBytes: 100},
+			err:  ErrLimitExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		tt.opts.AllowUnsigned = true
+
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(victim, []byte("victim"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			dest := t.TempDir()
+
+			err := UntarStream(context.Background(), buildTar(t, tt.entries()...), dest, &tt.opts)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("UntarStream() error = %v, want %v", err, tt.err)
+			}
+
+			b, err := os.ReadFile(victim)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(b) != "victim" {
+				t.Errorf("victim was overwritten with %q", b)
+			}
+
+			fi, err := os.Stat(victim)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if fi.Mode().Perm() != 0o600 {
+				t.Errorf("victim mode = %v, want 0600", fi.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestUntarStreamRestoresMetadata(t *testing.T) {
+	dest := t.TempDir()
+
+	buf := buildTar(t,
+		dirEntry("d/", 0o750),
+		fileEntry("d/f", "hello"),
+		symlinkEntry("d/l", "f"),
+		hardlinkEntry("d/h", "d/f"),
+	)
+
+	if err := UntarStream(context.Background(), buf, dest, unsigned); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dest, "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Mode().Perm() != 0o750 {
+		t.Errorf("d mode = %v, want 0750", fi.Mode().Perm())
+	}
+
+	b, err := os.ReadFile(filepath.Join(dest, "d", "l"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "hello" {
+		t.Errorf("d/l = %q, want %q", b, "hello")
+	}
+}
+
+func TestUntarStreamHardlinkToMissingTarget(t *testing.T) {
+	dest := t.TempDir()
+
+	buf := buildTar(t, hardlinkEntry("h", "a/b"))
+
+	err := UntarStream(context.Background(), buf, dest, unsigned)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("UntarStream() error = %v, want %v", err, fs.ErrNotExist)
+	}
+
+	for _, name := range []string{"a", "h"} {
+		if _, err := os.Lstat(filepath.Join(dest, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s exists after a failed hardlink: %v", name, err)
+		}
+	}
+}
+
+func TestUntarStreamCLILimits(t *testing.T) {
+	opts := &TarOptions{UseCLI: true, MaxFiles: 10}
+	opts.AllowUnsigned = true
+
+	if err := UntarStream(context.Background(), buildTar(t), t.TempDir(), opts); !errors.Is(err, errCLILimits) {
+		t.Fatalf("UntarStream() error = %v, want %v", err, errCLILimits)
+	}
+}
+
+func TestUntarStreamDefersFileFlags(t *testing.T) {
+	dest := t.TempDir()
+
+	// Flags would keep t.TempDir from removing the tree.
+	t.Cleanup(func() {
+		rt, err := openRoot(filepath.Dir(dest))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer rt.Close()
+
+		if err := removeAll(rt.fd, filepath.Base(dest)); err != nil {
+			t.Error(err)
+		}
+	})
+
+	flagged := fileEntry("bin/sh", "sh")
+	flagged.hdr.PAXRecords = map[string]string{paxFFlags: "uchg"}
+
+	buf := buildTar(t,
+		dirEntry("bin/", 0o755),
+		flagged,
+		hardlinkEntry("bin/-sh", "bin/sh"),
+		fileEntry("bin/sh.new", "sh"),
+	)
+
+	if err := UntarStream(context.Background(), buf, dest, unsigned); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dest, "bin", "-sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOOS == "freebsd" {
+		if got := fileFlags(fi); got != "uchg" {
+			t.Errorf("bin/-sh flags = %q, want %q", got, "uchg")
+		}
+	}
+
+	// Replacing a flagged file in a delta clears its flags first.
+	delta := buildTar(t, fileEntry("bin/sh", "new sh"))
+
+	opts := &TarOptions{ApplyDelta: true}
+	opts.AllowUnsigned = true
+
+	if err := UntarStream(context.Background(), delta, dest, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dest, "bin", "sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "new sh" {
+		t.Errorf("bin/sh = %q, want %q", b, "new sh")
+	}
+}
@@ -0,0 +1,245 @@
+package jam
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SignatureExt is appended to an archive's path to name its detached
+// signature.
+const SignatureExt = ".sig"
+
+var (
+	ErrUnsigned  = errors.New("archive is not signed")
+	ErrUntrusted = errors.New("archive signature is not trusted")
+)
+
+// DefaultRoot is the jam root whose trusted keys are used when
+// VerifyOptions has neither Keyring nor Root.
+const DefaultRoot = "/var/jam"
+
+// VerifyOptions controls the signature check run before an archive is
+// extracted. Unless AllowUnsigned is set, input without a Signature made by
+// one of the keys of Keyring is refused with ErrUnsigned or ErrUntrusted. A
+// nil Keyring is loaded from the trusted keys directory of Root.
+//
+// The signature covers the whole input, so the input is spooled to an
+// unlinked temporary file in TempDir, or os.TempDir when empty, and only
+// read back once it has been checked. That takes as much free space as the
+// input is large. Spooling stops with ErrLimitExceeded after MaxSpool
+// bytes; zero selects DefaultMaxSpool and a negative value means no limit.
+type VerifyOptions struct {
+	Signature     []byte
+	Keyring       *Keyring
+	Root          string
+	AllowUnsigned bool
+	TempDir       string
+	MaxSpool      int64
+}
+
+const DefaultMaxSpool = DefaultMaxBytes
+
+// verify copies src to an unlinked temporary file and checks the signature
+// over its digest. On success the file is returned rewound.
+func (o *VerifyOptions) verify(src io.Reader) (*os.File, Digest, error) {
+	if len(o.Signature) == 0 {
+		return nil, "", ErrUnsigned
+	}
+
+	kr := o.Keyring
+	if kr == nil {
+		root := o.Root
+		if root == "" {
+			root = DefaultRoot
+		}
+
+		var err error
+
+		if kr, err = LoadKeyring(root); err != nil {
+			return nil, "", err
+		}
+	}
+
+	f, err := os.CreateTemp(o.TempDir, ".jam-archive-*")
+	if err != nil {
+		return nil, "", err
+	}
+
+	os.Remove(f.Name())
+
+	limit := o.MaxSpool
+	if limit == 0 {
+		limit = DefaultMaxSpool
+	}
+
+	if limit > 0 {
+		src = io.LimitReader(src, limit+1)
+	}
+
+	h := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(f, h), src)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
+	if limit > 0 && n > limit {
+		f.Close()
+		return nil, "", fmt.Errorf("%w: more than %d bytes to verify", ErrLimitExceeded, limit)
+	}
+
+	digest := newDigest(h)
+
+	if _, err := kr.Verify(digest, o.Signature); err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
+	return f, digest, nil
+}
+
+// Keyring holds the public keys whose signatures are accepted on import.
+type Keyring struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// TrustedKeysDir returns the directory LoadKeyring reads under root.
+func TrustedKeysDir(root string) string {
+	return filepath.Join(root, "keys", "trusted")
+}
+
+// LoadKeyring reads every "<name>.pub" file, a base64 encoded ed25519
+// public key, from the trusted keys directory of root. A missing directory
+// yields an empty keyring, which trusts nothing.
+func LoadKeyring(root string) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[string]ed25519.PublicKey)}
+
+	paths, err := filepath.Glob(filepath.Join(TrustedKeysDir(root), "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := decodeKey(b, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+
+		kr.Add(strings.TrimSuffix(filepath.Base(p), ".pub"), ed25519.PublicKey(key))
+	}
+
+	return kr, nil
+}
+
+// TrustKey adds key to the trusted keys directory of root under name.
+func TrustKey(root, name string, key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize || name == "" || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("invalid key %q", name)
+	}
+
+	dir := TrustedKeysDir(root)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	return createAtomic(filepath.Join(dir, name+".pub"), func(w io.Writer) error {
+		_, err := io.WriteString(w, base64.StdEncoding.EncodeToString(key)+"\n")
+		return err
+	})
+}
+
+func (kr *Keyring) Add(name string, key ed25519.PublicKey) {
+	if kr.keys == nil {
+		kr.keys = make(map[string]ed25519.PublicKey)
+	}
+
+	kr.keys[name] = key
+}
+
+// Names returns the names of the trusted keys, sorted.
+func (kr *Keyring) Names() []string {
+	names := make([]string, 0, len(kr.keys))
+
+	for name := range kr.keys {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Verify checks sig over digest and returns the name of the key that made
+// it.
+func (kr *Keyring) Verify(digest Digest, sig []byte) (string, error) {
+	if len(sig) == 0 {
+		return "", ErrUnsigned
+	}
+
+	for _, name := range kr.Names() {
+		if ed25519.Verify(kr.keys[name], []byte(digest), sig) {
+			return name, nil
+		}
+	}
+
+	return "", ErrUntrusted
+}
+
+// Sign returns the detached signature of digest.
+func Sign(key ed25519.PrivateKey, digest Digest) []byte {
+	return ed25519.Sign(key, []byte(digest))
+}
+
+// ReadSignature reads the detached signature stored next to the archive at
+// pat. A missing signature file is not an error and yields nil.
+func ReadSignature(pat string) ([]byte, error) {
+	b, err := os.ReadFile(pat + SignatureExt)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeKey(b, ed25519.SignatureSize)
+}
+
+func writeSignature(pat string, sig []byte) error {
+	return createAtomic(pat+SignatureExt, func(w io.Writer) error {
+		_, err := io.WriteString(w, base64.StdEncoding.EncodeToString(sig)+"\n")
+		return err
+	})
+}
+
+func decodeKey(b []byte, size int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != size {
+		return nil, fmt.Errorf("expected %d bytes, got %d", size, len(key))
+	}
+
+	return key, nil
+}
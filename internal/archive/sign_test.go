@@ -0,0 +1,161 @@
+package jam
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignedArchiveRoundTrip(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "base.tar.zst")
+	out := filepath.Join(dir, "base.tar")
+
+	opts := &ArchiveOptions{Mode: ArchiveZStd, SigningKey: priv}
+	if err := ArchiveWithOptions(context.Background(), strings.NewReader("payload"), archive, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(archive + SignatureExt); err != nil {
+		t.Fatalf("signature not written: %v", err)
+	}
+
+	untrusted := &ArchiveOptions{Mode: ArchiveZStd}
+	untrusted.Root = root
+
+	if err := UnarchiveFile(context.Background(), archive, out, untrusted); !errors.Is(err, ErrUntrusted) {
+		t.Fatalf("UnarchiveFile() error = %v, want %v", err, ErrUntrusted)
+	}
+
+	if err := TrustKey(root, "release", pub); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UnarchiveFile(context.Background(), archive, out, untrusted); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "payload" {
+		t.Errorf("unarchived %q, want %q", b, "payload")
+	}
+}
+
+func TestUnsignedArchiveRejected(t *testing.T) {
+	var buf bytes.Buffer
+
+	if err := ArchiveStreamWithOptions(context.Background(), strings.NewReader("payload"), &buf, &ArchiveOptions{Mode: ArchiveGZip}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"UnarchiveStream", func() error {
+			return UnarchiveStream(context.Background(), bytes.NewReader(buf.Bytes()), &bytes.Buffer{}, nil)
+		}},
+		{"UnarchiveStreamWithOptions", func() error {
+			return UnarchiveStreamWithOptions(context.Background(), bytes.NewReader(buf.Bytes()), &bytes.Buffer{}, nil)
+		}},
+		{"UntarStream", func() error {
+			return UntarStream(context.Background(), buildTar(t, fileEntry("f", "x")), t.TempDir(), nil)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.run(); !errors.Is(err, ErrUnsigned) {
+				t.Fatalf("error = %v, want %v", err, ErrUnsigned)
+			}
+		})
+	}
+}
+
+func TestUntarStreamVerifiesSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := buildTar(t, fileEntry("f", "x"))
+
+	h := sha256.New()
+	h.Write(buf.Bytes())
+
+	opts := &TarOptions{}
+	opts.Signature = Sign(priv, newDigest(h))
+	opts.Keyring = &Keyring{}
+	opts.Keyring.Add("release", pub)
+
+	dest := t.TempDir()
+
+	if err := UntarStream(context.Background(), buf, dest, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dest, "f")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUntarStreamSpoolLimit(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := buildTar(t, fileEntry("f", "x"))
+
+	h := sha256.New()
+	h.Write(buf.Bytes())
+
+	opts := &TarOptions{}
+	opts.Signature = Sign(priv, newDigest(h))
+	opts.Keyring = &Keyring{}
+	opts.Keyring.Add("release", pub)
+	opts.MaxSpool = int64(buf.Len() - 1)
+
+	if err := UntarStream(context.Background(), buf, t.TempDir(), opts); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("UntarStream() error = %v, want %v", err, ErrLimitExceeded)
+	}
+}
+
+func TestArchiveWithOptionsRemovesArchiveWithoutSignature(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "base.tar")
+
+	// A directory in place of the signature makes writing it fail.
+	if err := os.Mkdir(dest+SignatureExt, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ArchiveOptions{SigningKey: priv}
+	if err := ArchiveWithOptions(context.Background(), strings.NewReader("payload"), dest, opts); err == nil {
+		t.Fatal("ArchiveWithOptions() succeeded")
+	}
+
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("archive left behind: %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+package jam
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	blockSize = 512
+
+	// holeSize is the granularity at which runs of zeros are turned back
+	// into holes on extraction.
+	holeSize = 4096
+
+	paxSparseMajor = "GNU.sparse.major"
+)
+
+// region is a range of a sparse file that holds data.
+type region struct {
+	off, len int64
+}
+
+// dataRegions returns the data regions of f using SEEK_DATA and SEEK_HOLE,
+// or nil if f has no holes or the file system cannot tell.
+func dataRegions(f *os.File, fi os.FileInfo) ([]region, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || fi.Size() == 0 || int64(st.Blocks)*blockSize >= fi.Size() {
+		return nil, nil
+	}
+
+	var (
+		regions []region
+		size    = fi.Size()
+		fd      = int(f.Fd())
+	)
+
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break
+		}
+
+		if err != nil {
+			if errors.Is(err, unix.EINVAL) {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+
+		regions = append(regions, region{off: data, len: hole - data})
+		off = hole
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if len(regions) == 1 && regions[0].len == size {
+		return nil, nil
+	}
+
+	// The map ends with an empty region at the end of the file so that
+	// readers size trailing holes correctly.
+	return append(regions, region{off: size}), nil
+}
+
+// writeSparse writes hdr and the data regions of f as a GNU sparse 1.0 PAX
+// entry straight to w, which tw writes to. archive/tar refuses to emit
+// GNU.sparse records itself, but reads them back. It returns errNotSparse
+// without writing anything if hdr cannot be encoded this way.
+func writeSparse(tw *tar.Writer, w io.Writer, hdr *tar.Header, f *os.File, regions []region, h hash.Hash) error {
+	var sm bytes.Buffer
+
+	fmt.Fprintf(&sm, "%d\n", len(regions))
+
+	stored := int64(0)
+	for _, r := range regions {
+		fmt.Fprintf(&sm, "%d\n%d\n", r.off, r.len)
+		stored += r.len
+	}
+
+	pad(&sm)
+	stored += int64(sm.Len())
+
+	records := map[string]string{
+		paxSparseMajor:        "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+		"size":                strconv.FormatInt(stored, 10),
+		"mtime":               fmt.Sprintf("%d.%09d", hdr.ModTime.Unix(), hdr.ModTime.Nanosecond()),
+	}
+
+	for k, v := range hdr.PAXRecords {
+		records[k] = v
+	}
+
+	var pax bytes.Buffer
+
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		pax.WriteString(paxRecord(k, records[k]))
+	}
+
+	base := path.Base(hdr.Name)
+	if len(base) > 80 {
+		base = base[:80]
+	}
+
+	paxBlk, err := headerBlock(&tar.Header{
+		Name:    "PaxHeaders.0/" + base,
+		Mode:    0o644,
+		Size:    int64(pax.Len()),
+		ModTime: hdr.ModTime,
+	}, tar.TypeXHeader)
+	if err != nil {
+		return err
+	}
+
+	fh := *hdr
+	fh.Name = "GNUSparseFile.0/" + base
+	fh.Size = stored
+	fh.PAXRecords = nil
+
+	// Sizes past the ustar limit are carried by the size record.
+	if stored >= 1<<33 {
+		fh.Size = 0
+	}
+
+	fileBlk, err := headerBlock(&fh, tar.TypeReg)
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	pad(&pax)
+
+	for _, b := range [][]byte{paxBlk, pax.Bytes(), fileBlk, sm.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	var end int64
+
+	for _, r := range regions {
+		if h != nil {
+			if _, err := io.CopyN(h, zeros{}, r.off-end); err != nil {
+				return err
+			}
+		}
+
+		dst := w
+		if h != nil {
+			dst = io.MultiWriter(w, h)
+		}
+
+		// The header already promised r.len bytes, so a file that
+		// shrank since would leave the archive corrupt.
+		n, err := io.Copy(dst, io.NewSectionReader(f, r.off, r.len))
+		if err != nil {
+			return err
+		}
+
+		if n != r.len {
+			return fmt.Errorf("%s: %w: region at %d has %d bytes, want %d", hdr.Name, io.ErrUnexpectedEOF, r.off, n, r.len)
+		}
+
+		end = r.off + r.len
+	}
+
+	if n := stored % blockSize; n != 0 {
+		_, err = w.Write(make([]byte, blockSize-n))
+	}
+
+	return err
+}
+
+var errNotSparse = errors.New("cannot encode sparse header")
+
+// headerBlock encodes hdr as a single ustar header block with the given
+// type flag.
+func headerBlock(hdr *tar.Header, typeflag byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	h := *hdr
+	h.Typeflag = tar.TypeReg
+	h.Format = tar.FormatUSTAR
+	h.ModTime = h.ModTime.Truncate(time.Second)
+	h.AccessTime = time.Time{}
+	h.ChangeTime = time.Time{}
+
+	if err := tar.NewWriter(&buf).WriteHeader(&h); err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotSparse, err)
+	}
+
+	blk := buf.Bytes()[:blockSize]
+	blk[156] = typeflag
+
+	copy(blk[148:156], "        ")
+
+	var sum int64
+	for _, c := range blk {
+		sum += int64(c)
+	}
+
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	return blk, nil
+}
+
+func paxRecord(k, v string) string {
+	const padding = 3 // Extra padding for ' ', '=', and '\n'
+
+	size := len(k) + len(v) + padding
+	size += len(strconv.Itoa(size))
+
+	rec := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+
+	// The length prefix counts itself and may have grown by a digit.
+	if len(rec) != size {
+		size = len(rec)
+		rec = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+
+	return rec
+}
+
+func pad(b *bytes.Buffer) {
+	if n := b.Len() % blockSize; n != 0 {
+		b.Write(make([]byte, blockSize-n))
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+func isSparse(hdr *tar.Header) bool {
+	_, ok := hdr.PAXRecords[paxSparseMajor]
+	return ok
+}
+
+// copySparse writes the contents read from r to f, seeking over blocks of
+// zeros instead of writing them so that holes are recreated.
+func copySparse(f *os.File, r io.Reader, size int64) error {
+	buf := make([]byte, 32*holeSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+
+		for b := buf[:n]; len(b) > 0; {
+			chunk := b
+			if len(chunk) > holeSize {
+				chunk = chunk[:holeSize]
+			}
+
+			if allZero(chunk) {
+				if _, err := f.Seek(int64(len(chunk)), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := f.Write(chunk); err != nil {
+				return err
+			}
+
+			b = b[len(chunk):]
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return f.Truncate(size)
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,213 @@
+package jam
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHeaderBlock(t *testing.T) {
+	hdr := &tar.Header{
+		Name:    "GNUSparseFile.0/f",
+		Mode:    0o644,
+		Size:    1024,
+		ModTime: time.Unix(1700000000, 500),
+	}
+
+	blk, err := headerBlock(hdr, tar.TypeXHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blk) != blockSize {
+		t.Fatalf("block is %d bytes, want %d", len(blk), blockSize)
+	}
+
+	if blk[156] != tar.TypeXHeader {
+		t.Errorf("typeflag = %q, want %q", blk[156], tar.TypeXHeader)
+	}
+
+	var sum int64
+	for i, c := range blk {
+		if i >= 148 && i < 156 {
+			c = ' '
+		}
+
+		sum += int64(c)
+	}
+
+	got, err := strconv.ParseInt(strings.TrimRight(string(blk[148:154]), "\x00 "), 8, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != sum {
+		t.Errorf("checksum = %o, want %o", got, sum)
+	}
+
+	// archive/tar validates the checksum when reading the block back.
+	blk, err = headerBlock(hdr, tar.TypeReg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := append(blk, make([]byte, hdr.Size+2*blockSize)...)
+
+	h, err := tar.NewReader(bytes.NewReader(archive)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Name != hdr.Name || h.Size != hdr.Size || !h.ModTime.Equal(hdr.ModTime.Truncate(time.Second)) {
+		t.Errorf("read back %+v", h)
+	}
+}
+
+func TestPaxRecord(t *testing.T) {
+	tests := []struct {
+		k, v string
+	}{
+		{"path", "f"},
+		// The length grows from one to two digits.
+		{"a", "bcd"},
+		{"a", "bcde"},
+		// And from two to three.
+		{"GNU.sparse.name", strings.Repeat("x", 80)},
+		{"GNU.sparse.name", strings.Repeat("x", 81)},
+		{"GNU.sparse.name", strings.Repeat("x", 82)},
+	}
+
+	for _, tt := range tests {
+		rec := paxRecord(tt.k, tt.v)
+
+		n, rest, ok := strings.Cut(rec, " ")
+		if !ok {
+			t.Fatalf("paxRecord(%q, %q) = %q has no length", tt.k, tt.v, rec)
+		}
+
+		if size, _ := strconv.Atoi(n); size != len(rec) {
+			t.Errorf("paxRecord(%q, %q) = %q, length %s, want %d", tt.k, tt.v, rec, n, len(rec))
+		}
+
+		if want := tt.k + "=" + tt.v + "\n"; rest != want {
+			t.Errorf("paxRecord(%q, %q) = %q, want record %q", tt.k, tt.v, rec, want)
+		}
+	}
+}
+
+func TestWriteSparseShortFile(t *testing.T) {
+	pat := filepath.Join(t.TempDir(), "f")
+
+	if err := os.WriteFile(pat, bytes.Repeat([]byte{1}, 100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(pat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	hdr := &tar.Header{Name: "f", Size: 8192, Mode: 0o644, ModTime: time.Unix(0, 0)}
+	regions := []region{{off: 0, len: 4096}, {off: 8192}}
+
+	var buf bytes.Buffer
+
+	err = writeSparse(tar.NewWriter(&buf), &buf, hdr, f, regions, nil)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("writeSparse() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	pat := filepath.Join(src, "sparse")
+
+	f, err := os.Create(pat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const size = 1 << 20
+
+	for _, off := range []int64{0, size / 2} {
+		if _, err := f.WriteAt(bytes.Repeat([]byte{'x'}, holeSize), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if allocated(t, pat) >= size {
+		t.Skip("the file system does not support holes")
+	}
+
+	var buf bytes.Buffer
+
+	if err := Tar(context.Background(), &buf, src, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the two data regions and the headers are stored.
+	if buf.Len() >= size/4 {
+		t.Errorf("archive is %d bytes, want well below %d", buf.Len(), size)
+	}
+
+	dest := t.TempDir()
+
+	if err := UntarStream(context.Background(), &buf, dest, unsigned); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := os.ReadFile(pat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "sparse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Error("sparse file contents differ after a round trip")
+	}
+
+	if n := allocated(t, filepath.Join(dest, "sparse")); n >= size {
+		t.Errorf("extracted file has %d bytes allocated, want its holes kept", n)
+	}
+}
+
+// allocated returns the number of bytes the file system allocated for
+// the file at pat.
+func allocated(t *testing.T, pat string) int64 {
+	t.Helper()
+
+	fi, err := os.Stat(pat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		t.Skip("no block count available")
+	}
+
+	return int64(st.Blocks) * 512
+}
@@ -0,0 +1,599 @@
+package jam
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	jail "github.com/edsonmichaque/jam/internal/jam"
+)
+
+const (
+	bsdtarCmd = "/usr/bin/bsdtar"
+
+	// paxFFlags carries file flags the same way bsdtar does.
+	paxFFlags = "SCHILY.fflags"
+)
+
+const (
+	DefaultMaxFiles = 1 << 22
+	DefaultMaxBytes = 1 << 40
+)
+
+var (
+	ErrLimitExceeded = errors.New("archive exceeds extraction limits")
+
+	errCLIManifest = errors.New("manifests are not supported with bsdtar")
+	errCLILimits   = errors.New("extraction limits are not supported with bsdtar")
+)
+
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// Tar writes the tree rooted at src to w as a PAX archive. Modes, ownership,
+// modification times, symlinks, hardlinks, device nodes, extended
+// attributes and, on FreeBSD, file flags are preserved. Holes in sparse
+// files are kept. Sockets are skipped.
+//
+// With Base set, only members that are new or differ from Base in type,
+// size, modification time, mode, ownership or link target are written,
+// followed by whiteouts for members that no longer exist. Manifest still
+// describes the whole tree, so it can serve as the base of the next delta.
+func Tar(ctx context.Context, w io.Writer, src string, opts *TarOptions) error {
+	if opts == nil {
+		opts = &TarOptions{
+			UseCLI: false,
+		}
+	}
+
+	manifest := opts.Manifest
+	if manifest == nil && opts.EmbedManifest {
+		manifest = new(Manifest)
+	}
+
+	if opts.UseCLI {
+		if manifest != nil || opts.Base != nil {
+			return errCLIManifest
+		}
+
+		p := newProgress(opts.Progress, opts.SizeHint)
+		w = &writer{ctx: ctx, w: w, p: p}
+
+		if err := runBsdtar(ctx, opts, &jail.Command{
+			Args:   []string{"-c", "-f", "-", "-C", src, "."},
+			Stdout: w,
+		}); err != nil {
+			return err
+		}
+
+		p.report()
+
+		return nil
+	}
+
+	var (
+		links = make(map[fileID]string)
+		base  map[string]*ManifestEntry
+		seen  map[string]string
+	)
+
+	if opts.Base != nil {
+		base = opts.Base.index()
+		seen = make(map[string]string, len(base))
+	}
+
+	total := opts.SizeHint
+	if total == 0 && opts.Progress != nil {
+		var err error
+
+		if total, err = treeSize(ctx, src, base); err != nil {
+			return err
+		}
+	}
+
+	p := newProgress(opts.Progress, total)
+	w = &writer{ctx: ctx, w: w, p: p}
+	tw := tar.NewWriter(w)
+
+	err := filepath.WalkDir(src, func(pat string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, pat)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := fileHeader(pat, filepath.ToSlash(rel), links)
+		if err != nil || hdr == nil {
+			return err
+		}
+
+		if opts.EmbedManifest && manifestName(hdr.Name) == ManifestName {
+			return fmt.Errorf("%s already exists in %s", ManifestName, src)
+		}
+
+		if base != nil {
+			if isWhiteout(hdr) {
+				return fmt.Errorf("%w: %s", errWhiteoutName, pat)
+			}
+
+			e := newManifestEntry(hdr, "")
+			seen[e.Name] = e.Type
+
+			if prev, ok := base[e.Name]; ok && prev.unchanged(hdr) {
+				if manifest != nil {
+					manifest.Entries = append(manifest.Entries, *prev)
+				}
+
+				return nil
+			}
+		}
+
+		sum, err := writeEntry(tw, w, pat, hdr, manifest != nil)
+		if err != nil {
+			return err
+		}
+
+		p.addEntry()
+
+		if hdr.Typeflag == tar.TypeReg {
+			p.addIn(hdr.Size)
+		}
+
+		if manifest == nil {
+			return nil
+		}
+
+		manifest.Entries = append(manifest.Entries, newManifestEntry(hdr, sum))
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if base != nil {
+		if err := writeWhiteouts(tw, opts.Base, seen); err != nil {
+			return err
+		}
+	}
+
+	if opts.EmbedManifest {
+		if err := writeManifest(tw, manifest); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	p.report()
+
+	return nil
+}
+
+// treeSize returns the number of bytes Tar will read from src: the size of
+// every regular file that differs from base, hardlinked files counted once.
+func treeSize(ctx context.Context, src string, base map[string]*ManifestEntry) (int64, error) {
+	var (
+		total int64
+		links = make(map[fileID]bool)
+	)
+
+	err := filepath.WalkDir(src, func(pat string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+			if links[id] {
+				return nil
+			}
+
+			links[id] = true
+		}
+
+		if base != nil {
+			rel, err := filepath.Rel(src, pat)
+			if err != nil {
+				return err
+			}
+
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+
+			if prev, ok := base[manifestName(filepath.ToSlash(rel))]; ok && prev.unchanged(hdr) {
+				return nil
+			}
+		}
+
+		total += fi.Size()
+
+		return nil
+	})
+
+	return total, err
+}
+
+// fileHeader returns the header for the file at pat archived as name, or
+// nil for files that are skipped.
+func fileHeader(pat, name string, links map[fileID]string) (*tar.Header, error) {
+	fi, err := os.Lstat(pat)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Mode()&fs.ModeSocket != 0 {
+		return nil, nil
+	}
+
+	var link string
+
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(pat); err != nil {
+			return nil, err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr.Format = tar.FormatPAX
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+
+	switch {
+	case name == ".":
+		hdr.Name = "./"
+	case fi.IsDir():
+		hdr.Name = name + "/"
+	default:
+		hdr.Name = name
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+		id := fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+
+		if first, ok := links[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			links[id] = hdr.Name
+		}
+	}
+
+	if flags := fileFlags(fi); flags != "" {
+		hdr.PAXRecords = map[string]string{paxFFlags: flags}
+	}
+
+	if err := addXattrs(hdr, pat); err != nil {
+		return nil, err
+	}
+
+	if err := addACL(hdr, pat); err != nil {
+		return nil, err
+	}
+
+	return hdr, nil
+}
+
+// writeEntry writes hdr followed by the contents of the file at pat to tw,
+// which writes to w, and returns the SHA-256 of regular files' contents
+// when sum is set. Files with holes are written as sparse entries.
+func writeEntry(tw *tar.Writer, w io.Writer, pat string, hdr *tar.Header, sum bool) (string, error) {
+	if hdr.Typeflag != tar.TypeReg {
+		return "", tw.WriteHeader(hdr)
+	}
+
+	f, err := os.Open(pat)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	var h hash.Hash
+	if sum {
+		h = sha256.New()
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	regions, err := dataRegions(f, fi)
+	if err != nil {
+		return "", err
+	}
+
+	if regions != nil && fi.Size() == hdr.Size {
+		err := writeSparse(tw, w, hdr, f, regions, h)
+		if err == nil {
+			if h == nil {
+				return "", nil
+			}
+
+			return hexSum(h), nil
+		}
+
+		if !errors.Is(err, errNotSparse) {
+			return "", err
+		}
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return "", err
+	}
+
+	if h == nil {
+		_, err = io.Copy(tw, f)
+		return "", err
+	}
+
+	if _, err := io.Copy(io.MultiWriter(tw, h), f); err != nil {
+		return "", err
+	}
+
+	return hexSum(h), nil
+}
+
+// UntarStream extracts the archive read from r into dest. Entries that
+// would land outside dest, through absolute names, ".." components,
+// symlinks or hardlinks, are rejected with ErrUnsafePath, and extraction
+// stops with ErrLimitExceeded once MaxFiles or MaxBytes is reached.
+// The signature of r is checked first, as described by VerifyOptions.
+// Ownership is only restored when running as root. With Verify or
+// VerifyEmbedded set, members are checked against the manifest and
+// ErrManifestMismatch is returned on any difference. ApplyDelta replays an
+// archive written by Tar with Base on top of the base tree in dest.
+func UntarStream(ctx context.Context, r io.Reader, dest string, opts *TarOptions) error {
+	if opts == nil {
+		opts = &TarOptions{
+			UseCLI: false,
+		}
+	}
+
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return err
+	}
+
+	p := newProgress(opts.Progress, opts.SizeHint)
+	r = &reader{ctx: ctx, r: r, p: p}
+
+	if !opts.AllowUnsigned {
+		f, _, err := opts.verify(r)
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+
+		// Only the spooling counts towards BytesIn.
+		r = &reader{ctx: ctx, r: f}
+	}
+
+	if opts.UseCLI {
+		if opts.Verify != nil || opts.VerifyEmbedded || opts.ApplyDelta {
+			return errCLIManifest
+		}
+
+		if opts.MaxFiles > 0 || opts.MaxBytes > 0 {
+			return errCLILimits
+		}
+
+		if err := runBsdtar(ctx, opts, &jail.Command{
+			Args:  []string{"-x", "-p", "-f", "-", "-C", dest},
+			Stdin: r,
+		}); err != nil {
+			return err
+		}
+
+		p.report()
+
+		return nil
+	}
+
+	rt, err := openRoot(dest)
+	if err != nil {
+		return err
+	}
+
+	defer rt.Close()
+
+	rt.replace = opts.ApplyDelta
+
+	var (
+		tr    = tar.NewReader(r)
+		dirs  []*tar.Header
+		flags []*tar.Header
+		files int
+		total int64
+		v     *verifier
+		found bool
+	)
+
+	if opts.Verify != nil || opts.VerifyEmbedded {
+		v = newVerifier(opts.Verify)
+	}
+
+	maxFiles, maxBytes := opts.limits()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if files++; maxFiles >= 0 && files > maxFiles {
+			return fmt.Errorf("%w: more than %d entries", ErrLimitExceeded, maxFiles)
+		}
+
+		if total += hdr.Size; maxBytes >= 0 && total > maxBytes {
+			return fmt.Errorf("%w: more than %d bytes", ErrLimitExceeded, maxBytes)
+		}
+
+		// Without verification the manifest is an ordinary file.
+		if v != nil && manifestName(hdr.Name) == ManifestName && hdr.Typeflag == tar.TypeReg {
+			found = true
+
+			if err := v.embedded(tr); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if opts.ApplyDelta && isWhiteout(hdr) {
+			if err := rt.whiteout(hdr); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if v == nil {
+			if err := rt.extract(tr, hdr); err != nil {
+				return err
+			}
+		} else {
+			h := sha256.New()
+
+			if err := rt.extract(io.TeeReader(tr, h), hdr); err != nil {
+				return err
+			}
+
+			var sum string
+			if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+				sum = hexSum(h)
+			}
+
+			if err := v.check(newManifestEntry(hdr, sum)); err != nil {
+				return err
+			}
+		}
+
+		p.addEntry()
+
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			p.addOut(hdr.Size)
+		}
+
+		if hdr.PAXRecords[paxFFlags] != "" {
+			flags = append(flags, hdr)
+		}
+
+		// Directory metadata is applied last so that creating their
+		// contents does not alter it.
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+			continue
+		}
+
+		if err := rt.setMetadata(hdr); err != nil {
+			return err
+		}
+	}
+
+	if v != nil {
+		if opts.VerifyEmbedded && !found {
+			return fmt.Errorf("%w: archive has no embedded manifest", ErrManifestMismatch)
+		}
+
+		// A delta only carries what changed, so the rest of the
+		// manifest is expected to be missing.
+		if !opts.ApplyDelta {
+			if err := v.finish(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := rt.setMetadata(dirs[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := len(flags) - 1; i >= 0; i-- {
+		if err := rt.setFlags(flags[i]); err != nil {
+			return err
+		}
+	}
+
+	p.report()
+
+	return nil
+}
+
+func runBsdtar(ctx context.Context, opts *TarOptions, cmd *jail.Command) error {
+	runner := opts.Runner
+	if runner == nil {
+		runner = jail.DefaultRunner
+	}
+
+	cmd.Path = bsdtarCmd
+
+	return runner.Run(ctx, cmd)
+}
+
+// limits returns the extraction limits, with zero meaning the default and a
+// negative value meaning unlimited.
+func (o *TarOptions) limits() (int, int64) {
+	maxFiles, maxBytes := o.MaxFiles, o.MaxBytes
+
+	if maxFiles == 0 {
+		maxFiles = DefaultMaxFiles
+	}
+
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxBytes
+	}
+
+	return maxFiles, maxBytes
+}
@@ -0,0 +1,87 @@
+package jam
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileFlagNames follows the spelling of chflags(1) and bsdtar.
+var fileFlagNames = []struct {
+	name string
+	flag uint32
+}{
+	{"nodump", 0x00000001},
+	{"uchg", 0x00000002},
+	{"uappnd", 0x00000004},
+	{"opaque", 0x00000008},
+	{"uunlnk", 0x00000010},
+	{"usystem", 0x00000080},
+	{"usparse", 0x00000100},
+	{"uoffline", 0x00000200},
+	{"ureparse", 0x00000400},
+	{"uarch", 0x00000800},
+	{"urdonly", 0x00001000},
+	{"uhidden", 0x00008000},
+	{"arch", 0x00010000},
+	{"schg", 0x00020000},
+	{"sappnd", 0x00040000},
+	{"sunlnk", 0x00100000},
+}
+
+func fileFlags(fi fs.FileInfo) string {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || st.Flags == 0 {
+		return ""
+	}
+
+	var names []string
+
+	for _, f := range fileFlagNames {
+		if st.Flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+func setFileFlags(fd int, flags string) error {
+	var set uint32
+
+	for _, name := range strings.Split(flags, ",") {
+		found := false
+
+		for _, f := range fileFlagNames {
+			if f.name == name {
+				set |= f.flag
+				found = true
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("unknown file flag %q", name)
+		}
+	}
+
+	return unix.Fchflags(fd, int(set))
+}
+
+// clearFileFlags removes the flags of name so that it can be unlinked or
+// replaced. Failures are left for the following operation to report.
+func clearFileFlags(dirfd int, name string) {
+	p, err := unix.BytePtrFromString(name)
+	if err != nil {
+		return
+	}
+
+	unix.Syscall6(unix.SYS_CHFLAGSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), 0, unix.AT_SYMLINK_NOFOLLOW, 0, 0)
+}
+
+func mknodat(dirfd int, name string, mode, major, minor uint32) error {
+	return unix.Mknodat(dirfd, name, mode, unix.Mkdev(major, minor))
+}
@@ -0,0 +1,22 @@
+package jam
+
+import (
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+func fileFlags(fs.FileInfo) string {
+	return ""
+}
+
+// setFileFlags ignores FreeBSD file flags, which Linux cannot represent.
+func setFileFlags(int, string) error {
+	return nil
+}
+
+func clearFileFlags(int, string) {}
+
+func mknodat(dirfd int, name string, mode, major, minor uint32) error {
+	return unix.Mknodat(dirfd, name, mode, int(unix.Mkdev(major, minor)))
+}
@@ -0,0 +1,58 @@
+package jam
+
+import (
+	"archive/tar"
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// paxXattr prefixes the records carrying extended attributes, named
+// "<namespace>.<name>" as on Linux. POSIX ACLs travel as the attributes
+// they are stored in.
+const paxXattr = "SCHILY.xattr."
+
+// xattrUnsupported reports whether err means the file system or our
+// privileges do not allow the attribute, in which case it is skipped.
+func xattrUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) ||
+		errors.Is(err, unix.EPERM) || errors.Is(err, unix.EACCES)
+}
+
+func addXattrs(hdr *tar.Header, pat string) error {
+	attrs, err := listXattrs(pat)
+	if err != nil {
+		if xattrUnsupported(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	for name, value := range attrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+
+		hdr.PAXRecords[paxXattr+name] = value
+	}
+
+	return nil
+}
+
+// setXattrs restores the extended attributes of hdr on the open file fd.
+func setXattrs(fd int, hdr *tar.Header) error {
+	for k, v := range hdr.PAXRecords {
+		attr, ok := strings.CutPrefix(k, paxXattr)
+		if !ok {
+			continue
+		}
+
+		if err := setXattr(fd, attr, []byte(v)); err != nil && !xattrUnsupported(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package jam
+
+import (
+	"errors"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var extattrNamespaces = []struct {
+	name string
+	ns   int
+}{
+	{"user", unix.EXTATTR_NAMESPACE_USER},
+	{"system", unix.EXTATTR_NAMESPACE_SYSTEM},
+}
+
+func listXattrs(pat string) (map[string]string, error) {
+	attrs := make(map[string]string)
+
+	for _, ns := range extattrNamespaces {
+		list, err := extattrBuf(func(p uintptr, n int) (int, error) {
+			return unix.ExtattrListLink(pat, ns.ns, p, n)
+		})
+		if xattrUnsupported(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// The list is a sequence of names, each preceded by its length.
+		for len(list) > 0 {
+			n := int(list[0])
+			if n+1 > len(list) {
+				break
+			}
+
+			name := string(list[1 : n+1])
+			list = list[n+1:]
+
+			value, err := extattrBuf(func(p uintptr, n int) (int, error) {
+				return unix.ExtattrGetLink(pat, ns.ns, name, p, n)
+			})
+			if errors.Is(err, unix.ENOATTR) || xattrUnsupported(err) {
+				continue
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			attrs[ns.name+"."+name] = string(value)
+		}
+	}
+
+	return attrs, nil
+}
+
+// extattrBuf calls get with a buffer large enough for its result, which
+// may grow between the size query and the actual call.
+func extattrBuf(get func(uintptr, int) (int, error)) ([]byte, error) {
+	for {
+		n, err := get(0, 0)
+		if err != nil || n == 0 {
+			return nil, err
+		}
+
+		b := make([]byte, n+1)
+
+		m, err := get(uintptr(unsafe.Pointer(&b[0])), len(b))
+		if err != nil {
+			return nil, err
+		}
+
+		if m < len(b) {
+			return b[:m], nil
+		}
+	}
+}
+
+func setXattr(fd int, name string, value []byte) error {
+	nsName, attr, ok := strings.Cut(name, ".")
+	if !ok {
+		return unix.EOPNOTSUPP
+	}
+
+	for _, ns := range extattrNamespaces {
+		if ns.name != nsName {
+			continue
+		}
+
+		var p uintptr
+		if len(value) > 0 {
+			p = uintptr(unsafe.Pointer(&value[0]))
+		}
+
+		_, err := unix.ExtattrSetFd(fd, ns.ns, attr, p, len(value))
+
+		return err
+	}
+
+	// Namespaces FreeBSD lacks, e.g. Linux security or trusted
+	// attributes, are not restored.
+	return unix.EOPNOTSUPP
+}
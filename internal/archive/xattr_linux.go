@@ -0,0 +1,64 @@
+package jam
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+func listXattrs(pat string) (map[string]string, error) {
+	names, err := xattrBuf(func(b []byte) (int, error) {
+		return unix.Llistxattr(pat, b)
+	})
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	attrs := make(map[string]string)
+
+	for _, name := range bytes.Split(bytes.TrimRight(names, "\x00"), []byte{0}) {
+		value, err := xattrBuf(func(b []byte) (int, error) {
+			return unix.Lgetxattr(pat, string(name), b)
+		})
+		if errors.Is(err, unix.ENODATA) || xattrUnsupported(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		attrs[string(name)] = string(value)
+	}
+
+	return attrs, nil
+}
+
+// xattrBuf calls get with a buffer large enough for its result, which may
+// grow between the size query and the actual call.
+func xattrBuf(get func([]byte) (int, error)) ([]byte, error) {
+	for {
+		n, err := get(nil)
+		if err != nil || n == 0 {
+			return nil, err
+		}
+
+		b := make([]byte, n)
+
+		n, err = get(b)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return b[:n], nil
+	}
+}
+
+func setXattr(fd int, name string, value []byte) error {
+	return unix.Fsetxattr(fd, name, value, 0)
+}
@@ -0,0 +1,467 @@
+// Package ipam hands out jail addresses from CIDR pools and records the
+// leases under the jam root so that they survive restarts of jamd and
+// concurrent jamctl invocations.
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/edsonmichaque/jam/internal/jam"
+)
+
+var (
+	ErrExhausted = errors.New("ipam: no free address")
+	ErrConflict  = errors.New("ipam: address already leased")
+	ErrBadConfig = errors.New("ipam: invalid jail configuration")
+)
+
+// Lease binds an address to a jail. Static leases record addresses that
+// were configured by hand rather than allocated.
+type Lease struct {
+	Jail   string     `json:"Jail"`
+	Addr   netip.Addr `json:"Addr"`
+	Static bool       `json:"Static,omitempty"`
+}
+
+type leaseFile struct {
+	Leases []Lease `json:"Leases"`
+}
+
+// Manager allocates addresses from its pools. The network address, the
+// IPv4 broadcast address and the first host of each pool are never handed
+// out, the latter being left for the gateway.
+type Manager struct {
+	root  string
+	pools []netip.Prefix
+	mu    sync.Mutex
+}
+
+func New(root string, pools ...netip.Prefix) (*Manager, error) {
+	if len(pools) == 0 {
+		return nil, errors.New("ipam: no pools")
+	}
+
+	masked := make([]netip.Prefix, 0, len(pools))
+
+	for _, p := range pools {
+		if !p.IsValid() {
+			return nil, fmt.Errorf("ipam: invalid pool %s", p)
+		}
+
+		masked = append(masked, p.Masked())
+	}
+
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Manager{root: root, pools: masked}, nil
+}
+
+func (m *Manager) leasePath() string {
+	return filepath.Join(m.root, "ipam.json")
+}
+
+// update runs fn on the current leases while holding both the in-process
+// mutex and an exclusive lock on the lease file, then persists the result
+// atomically.
+func (m *Manager) update(fn func(*leaseFile) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lock, err := os.OpenFile(filepath.Join(m.root, "ipam.lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+
+	defer lock.Close()
+
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	leases, err := m.load()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(leases); err != nil {
+		return err
+	}
+
+	return m.save(leases)
+}
+
+func (m *Manager) load() (*leaseFile, error) {
+	var leases leaseFile
+
+	b, err := os.ReadFile(m.leasePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return &leases, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &leases); err != nil {
+		return nil, fmt.Errorf("ipam: %s: %w", m.leasePath(), err)
+	}
+
+	return &leases, nil
+}
+
+func (m *Manager) save(leases *leaseFile) error {
+	sort.Slice(leases.Leases, func(i, j int) bool {
+		return leases.Leases[i].Addr.Less(leases.Leases[j].Addr)
+	})
+
+	b, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(m.root, ".ipam-*.json")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), m.leasePath())
+}
+
+// Leases returns all current leases ordered by address.
+func (m *Manager) Leases() ([]Lease, error) {
+	var leases []Lease
+
+	err := m.update(func(f *leaseFile) error {
+		leases = append(leases, f.Leases...)
+		return nil
+	})
+
+	return leases, err
+}
+
+// Allocate leases a free address of the requested family to jail. A jail
+// that already holds an address of that family gets it back.
+func (m *Manager) Allocate(jail string, ipv6 bool) (netip.Addr, error) {
+	var addr netip.Addr
+
+	err := m.update(func(f *leaseFile) error {
+		var err error
+
+		addr, _, err = m.allocate(f, jail, ipv6)
+
+		return err
+	})
+
+	return addr, err
+}
+
+// Reserve records a statically configured address for jail, failing with
+// ErrConflict if another jail already holds it.
+func (m *Manager) Reserve(jail string, addr netip.Addr) error {
+	return m.update(func(f *leaseFile) error {
+		return reserve(f, jail, addr)
+	})
+}
+
+// Release drops every lease held by jail.
+func (m *Manager) Release(jail string) error {
+	return m.update(func(f *leaseFile) error {
+		kept := f.Leases[:0]
+
+		for _, l := range f.Leases {
+			if l.Jail != jail {
+				kept = append(kept, l)
+			}
+		}
+
+		f.Leases = kept
+
+		return nil
+	})
+}
+
+// ReserveConfigs records the addresses of the jails configured in the
+// jail.conf files of dir as static leases, so that jails written by hand
+// or before IPAM was in use never get their address handed out again.
+// Addresses outside the pools are ignored. Files and jails that cannot be
+// parsed are skipped; they are reported together in an error matching
+// ErrBadConfig once the other addresses have been reserved.
+func (m *Manager) ReserveConfigs(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.conf"))
+	if err != nil {
+		return err
+	}
+
+	var (
+		static  = make(map[string][]netip.Addr)
+		names   []string
+		skipped []error
+	)
+
+	for _, pat := range paths {
+		jails, err := jam.ParseConfigFile(pat)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("%w: %s: %v", ErrBadConfig, pat, err))
+			continue
+		}
+
+		for _, opts := range jails {
+			addrs, err := staticAddrs(opts)
+			if err != nil {
+				skipped = append(skipped, fmt.Errorf("%w: %s: jail %s: %v", ErrBadConfig, pat, opts.Name, err))
+				continue
+			}
+
+			if _, ok := static[opts.Name]; !ok {
+				names = append(names, opts.Name)
+			}
+
+			static[opts.Name] = append(static[opts.Name], addrs...)
+		}
+	}
+
+	err = m.update(func(f *leaseFile) error {
+		for _, name := range names {
+			for _, a := range static[name] {
+				if !m.contains(a) {
+					continue
+				}
+
+				if err := reserve(f, name, a); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(skipped...)
+}
+
+// Assign reserves the static addresses already present in opts and fills
+// in an address for each family that has a pool but no configured address.
+// Managed VNET jails receive their address with the pool's prefix length in
+// VNet.Addr; other jails receive a host address in ip4.addr or ip6.addr.
+func (m *Manager) Assign(opts *jam.CreateOptions) error {
+	return m.update(func(f *leaseFile) error {
+		vnet := opts.VNet != nil && opts.VNet.Bridge != ""
+
+		static, err := staticAddrs(opts)
+		if err != nil {
+			return err
+		}
+
+		for _, a := range static {
+			if m.contains(a) {
+				if err := reserve(f, opts.Name, a); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, ipv6 := range []bool{false, true} {
+			if hasFamily(static, ipv6) || !m.hasPool(ipv6) || disabled(opts, ipv6) {
+				continue
+			}
+
+			addr, pool, err := m.allocate(f, opts.Name, ipv6)
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case vnet:
+				opts.VNet.Addr = append(opts.VNet.Addr, netip.PrefixFrom(addr, pool.Bits()).String())
+			case ipv6:
+				if opts.IPv6 == nil {
+					opts.IPv6 = new(jam.IPv6Options)
+				}
+
+				opts.IPv6.Addr = append(opts.IPv6.Addr, addr.String())
+			default:
+				if opts.IPv4 == nil {
+					opts.IPv4 = new(jam.IPv4Options)
+				}
+
+				opts.IPv4.Addr = append(opts.IPv4.Addr, addr.String())
+			}
+		}
+
+		return nil
+	})
+}
+
+// allocate returns an address jail already holds in one of the pools of
+// the family, or leases a new one.
+func (m *Manager) allocate(f *leaseFile, jail string, ipv6 bool) (netip.Addr, netip.Prefix, error) {
+	used := make(map[netip.Addr]bool, len(f.Leases))
+	for _, l := range f.Leases {
+		used[l.Addr] = true
+	}
+
+	for _, pool := range m.pools {
+		if pool.Addr().Is6() != ipv6 {
+			continue
+		}
+
+		for _, l := range f.Leases {
+			if l.Jail == jail && pool.Contains(l.Addr) {
+				return l.Addr, pool, nil
+			}
+		}
+	}
+
+	for _, pool := range m.pools {
+		if pool.Addr().Is6() != ipv6 {
+			continue
+		}
+
+		// Skip the network address and the gateway.
+		addr := pool.Addr().Next().Next()
+
+		for ; addr.IsValid() && pool.Contains(addr); addr = addr.Next() {
+			if !ipv6 && pool.Bits() < 31 && !pool.Contains(addr.Next()) {
+				break // broadcast
+			}
+
+			if used[addr] {
+				continue
+			}
+
+			f.Leases = append(f.Leases, Lease{Jail: jail, Addr: addr})
+
+			return addr, pool, nil
+		}
+	}
+
+	return netip.Addr{}, netip.Prefix{}, ErrExhausted
+}
+
+func reserve(f *leaseFile, jail string, addr netip.Addr) error {
+	for _, l := range f.Leases {
+		if l.Addr != addr {
+			continue
+		}
+
+		if l.Jail != jail {
+			return fmt.Errorf("%w: %s is held by %s", ErrConflict, addr, l.Jail)
+		}
+
+		return nil
+	}
+
+	f.Leases = append(f.Leases, Lease{Jail: jail, Addr: addr, Static: true})
+
+	return nil
+}
+
+func (m *Manager) contains(a netip.Addr) bool {
+	for _, p := range m.pools {
+		if p.Contains(a) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *Manager) hasPool(ipv6 bool) bool {
+	for _, p := range m.pools {
+		if p.Addr().Is6() == ipv6 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func staticAddrs(opts *jam.CreateOptions) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+
+	var entries []string
+
+	if opts.IPv4 != nil {
+		entries = append(entries, opts.IPv4.Addr...)
+	}
+
+	if opts.IPv6 != nil {
+		entries = append(entries, opts.IPv6.Addr...)
+	}
+
+	for _, s := range entries {
+		_, prefix, err := jam.ParseIPAddr(s)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs = append(addrs, prefix.Addr())
+	}
+
+	if opts.VNet != nil {
+		for _, s := range opts.VNet.Addr {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+
+			addrs = append(addrs, prefix.Addr())
+		}
+	}
+
+	return addrs, nil
+}
+
+func hasFamily(addrs []netip.Addr, ipv6 bool) bool {
+	for _, a := range addrs {
+		if a.Is6() == ipv6 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func disabled(opts *jam.CreateOptions, ipv6 bool) bool {
+	mode := jam.IPMode("")
+
+	if ipv6 && opts.IPv6 != nil {
+		mode = opts.IPv6.Mode
+	} else if !ipv6 && opts.IPv4 != nil {
+		mode = opts.IPv4.Mode
+	}
+
+	return mode == jam.IPInherit || mode == jam.IPDisable
+}
@@ -0,0 +1,224 @@
+package ipam
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/edsonmichaque/jam/internal/jam"
+)
+
+func newManager(t *testing.T, root string, pools ...string) *Manager {
+	t.Helper()
+
+	prefixes := make([]netip.Prefix, 0, len(pools))
+
+	for _, p := range pools {
+		prefixes = append(prefixes, netip.MustParsePrefix(p))
+	}
+
+	m, err := New(root, prefixes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestAllocateOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		pool string
+		ipv6 bool
+		want []string
+	}{
+		{
+			name: "ipv4 skips network, gateway and broadcast",
+			pool: "10.0.0.0/29",
+			want: []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"},
+		},
+		{
+			name: "ipv4 unmasked pool",
+			pool: "10.0.0.9/30",
+			want: []string{"10.0.0.10"},
+		},
+		{
+			name: "ipv6 has no broadcast",
+			pool: "fd00::/126",
+			ipv6: true,
+			want: []string{"fd00::2", "fd00::3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newManager(t, t.TempDir(), tt.pool)
+
+			for i, want := range tt.want {
+				addr, err := m.Allocate(string(rune('a'+i)), tt.ipv6)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if addr.String() != want {
+					t.Errorf("Allocate() #%d = %s, want %s", i, addr, want)
+				}
+			}
+
+			if _, err := m.Allocate("last", tt.ipv6); !errors.Is(err, ErrExhausted) {
+				t.Errorf("Allocate() on a full pool error = %v, want %v", err, ErrExhausted)
+			}
+		})
+	}
+}
+
+func TestLeasesPersist(t *testing.T) {
+	root := t.TempDir()
+
+	if _, err := newManager(t, root, "10.0.0.0/24").Allocate("web", false); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newManager(t, root, "10.0.0.0/24")
+
+	leases, err := m.Leases()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leases) != 1 || leases[0].Jail != "web" || leases[0].Addr.String() != "10.0.0.2" {
+		t.Fatalf("Leases() = %v, want web at 10.0.0.2", leases)
+	}
+
+	addr, err := m.Allocate("db", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr.String() != "10.0.0.3" {
+		t.Errorf("Allocate() = %s, want 10.0.0.3", addr)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	m := newManager(t, t.TempDir(), "10.0.0.0/24")
+
+	for _, jail := range []string{"web", "db"} {
+		if _, err := m.Allocate(jail, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.Release("web"); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := m.Allocate("cache", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr.String() != "10.0.0.2" {
+		t.Errorf("Allocate() after Release = %s, want 10.0.0.2", addr)
+	}
+}
+
+func TestReserveConflict(t *testing.T) {
+	m := newManager(t, t.TempDir(), "10.0.0.0/24")
+	addr := netip.MustParseAddr("10.0.0.2")
+
+	if err := m.Reserve("web", addr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Reserve("web", addr); err != nil {
+		t.Errorf("Reserve() by the holder error = %v", err)
+	}
+
+	if err := m.Reserve("db", addr); !errors.Is(err, ErrConflict) {
+		t.Errorf("Reserve() error = %v, want %v", err, ErrConflict)
+	}
+}
+
+func TestReserveConfigs(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"web.conf":  "web {\n\tpath = \"/jails/web\";\n\tip4.addr = \"em0|10.0.0.2/24\";\n}\n",
+		"ext.conf":  "ext {\n\tpath = \"/jails/ext\";\n\tip4.addr = \"192.0.2.10\";\n}\n",
+		"bad.conf":  "bad {\n\tpath = \"/jails/bad\"\n",
+		"addr.conf": "addr {\n\tpath = \"/jails/addr\";\n\tip4.addr = \"not an address\";\n}\n",
+	}
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := newManager(t, t.TempDir(), "10.0.0.0/24")
+
+	err := m.ReserveConfigs(dir)
+	if !errors.Is(err, ErrBadConfig) {
+		t.Fatalf("ReserveConfigs() error = %v, want %v", err, ErrBadConfig)
+	}
+
+	leases, err := m.Leases()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Lease{Jail: "web", Addr: netip.MustParseAddr("10.0.0.2"), Static: true}
+	if len(leases) != 1 || leases[0] != want {
+		t.Fatalf("Leases() = %v, want %v", leases, want)
+	}
+
+	opts := &jam.CreateOptions{
+		Name: "db",
+		IPv4: &jam.IPv4Options{IPOptions: jam.IPOptions{Addr: []string{"10.0.0.2"}}},
+	}
+
+	if err := m.Assign(opts); !errors.Is(err, ErrConflict) {
+		t.Errorf("Assign() of a configured address error = %v, want %v", err, ErrConflict)
+	}
+
+	addr, err := m.Allocate("db", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr.String() != "10.0.0.3" {
+		t.Errorf("Allocate() = %s, want 10.0.0.3", addr)
+	}
+}
+
+func TestAssignReusesLease(t *testing.T) {
+	m := newManager(t, t.TempDir(), "10.0.0.0/24", "fd00::/64")
+
+	for i := 0; i < 3; i++ {
+		opts := &jam.CreateOptions{Name: "web"}
+
+		if err := m.Assign(opts); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := opts.IPv4.Addr; len(got) != 1 || got[0] != "10.0.0.2" {
+			t.Errorf("run %d: ip4.addr = %v, want [10.0.0.2]", i, got)
+		}
+
+		if got := opts.IPv6.Addr; len(got) != 1 || got[0] != "fd00::2" {
+			t.Errorf("run %d: ip6.addr = %v, want [fd00::2]", i, got)
+		}
+	}
+
+	leases, err := m.Leases()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leases) != 2 {
+		t.Errorf("Leases() = %v, want one per family", leases)
+	}
+}
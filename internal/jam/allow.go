@@ -0,0 +1,110 @@
+package jam
+
+import "strings"
+
+// AllowOptions models the allow.* parameters. A nil field leaves the
+// jail(8) default in place, while an explicit false is written as
+// "allow.noX" so that the permission is denied even if inherited.
+type AllowOptions struct {
+	SetHostname                 *bool `json:"SetHostname,omitempty"`
+	SysVIPC                     *bool `json:"SysVIPC,omitempty"`
+	RawSockets                  *bool `json:"RawSockets,omitempty"`
+	Chflags                     *bool `json:"Chflags,omitempty"`
+	Mount                       *bool `json:"Mount,omitempty"`
+	MountDevFS                  *bool `json:"MountDevFS,omitempty"`
+	MountFdescFS                *bool `json:"MountFdescFS,omitempty"`
+	MountFuseFS                 *bool `json:"MountFuseFS,omitempty"`
+	MountNullFS                 *bool `json:"MountNullFS,omitempty"`
+	MountProcFS                 *bool `json:"MountProcFS,omitempty"`
+	MountLinProcFS              *bool `json:"MountLinProcFS,omitempty"`
+	MountLinSysFS               *bool `json:"MountLinSysFS,omitempty"`
+	MountTmpFS                  *bool `json:"MountTmpFS,omitempty"`
+	MountZFS                    *bool `json:"MountZFS,omitempty"`
+	Quotas                      *bool `json:"Quotas,omitempty"`
+	ReadMsgbuf                  *bool `json:"ReadMsgbuf,omitempty"`
+	SocketAF                    *bool `json:"SocketAF,omitempty"`
+	Mlock                       *bool `json:"Mlock,omitempty"`
+	NFSD                        *bool `json:"NFSD,omitempty"`
+	ReservedPorts               *bool `json:"ReservedPorts,omitempty"`
+	UnprivilegedProcDebug       *bool `json:"UnprivilegedProcDebug,omitempty"`
+	Suser                       *bool `json:"Suser,omitempty"`
+	VMM                         *bool `json:"VMM,omitempty"`
+	ExtAttr                     *bool `json:"ExtAttr,omitempty"`
+	AdjTime                     *bool `json:"AdjTime,omitempty"`
+	SetTime                     *bool `json:"SetTime,omitempty"`
+	Routing                     *bool `json:"Routing,omitempty"`
+	UnprivilegedParentTampering *bool `json:"UnprivilegedParentTampering,omitempty"`
+}
+
+type boolField struct {
+	name  string
+	field string
+	value **bool
+}
+
+func (o *AllowOptions) fields() []boolField {
+	return []boolField{
+		{"allow.set_hostname", "SetHostname", &o.SetHostname},
+		{"allow.sysvipc", "SysVIPC", &o.SysVIPC},
+		{"allow.raw_sockets", "RawSockets", &o.RawSockets},
+		{"allow.chflags", "Chflags", &o.Chflags},
+		{"allow.mount", "Mount", &o.Mount},
+		{"allow.mount.devfs", "MountDevFS", &o.MountDevFS},
+		{"allow.mount.fdescfs", "MountFdescFS", &o.MountFdescFS},
+		{"allow.mount.fusefs", "MountFuseFS", &o.MountFuseFS},
+		{"allow.mount.nullfs", "MountNullFS", &o.MountNullFS},
+		{"allow.mount.procfs", "MountProcFS", &o.MountProcFS},
+		{"allow.mount.linprocfs", "MountLinProcFS", &o.MountLinProcFS},
+		{"allow.mount.linsysfs", "MountLinSysFS", &o.MountLinSysFS},
+		{"allow.mount.tmpfs", "MountTmpFS", &o.MountTmpFS},
+		{"allow.mount.zfs", "MountZFS", &o.MountZFS},
+		{"allow.quotas", "Quotas", &o.Quotas},
+		{"allow.read_msgbuf", "ReadMsgbuf", &o.ReadMsgbuf},
+		{"allow.socket_af", "SocketAF", &o.SocketAF},
+		{"allow.mlock", "Mlock", &o.Mlock},
+		{"allow.nfsd", "NFSD", &o.NFSD},
+		{"allow.reserved_ports", "ReservedPorts", &o.ReservedPorts},
+		{"allow.unprivileged_proc_debug", "UnprivilegedProcDebug", &o.UnprivilegedProcDebug},
+		{"allow.suser", "Suser", &o.Suser},
+		{"allow.vmm", "VMM", &o.VMM},
+		{"allow.extattr", "ExtAttr", &o.ExtAttr},
+		{"allow.adjtime", "AdjTime", &o.AdjTime},
+		{"allow.settime", "SetTime", &o.SetTime},
+		{"allow.routing", "Routing", &o.Routing},
+		{"allow.unprivileged_parent_tampering", "UnprivilegedParentTampering", &o.UnprivilegedParentTampering},
+	}
+}
+
+// field returns the field backing the named allow.* parameter, or nil.
+func (o *AllowOptions) field(name string) **bool {
+	for _, f := range o.fields() {
+		if f.name == name {
+			return f.value
+		}
+	}
+
+	return nil
+}
+
+func (o *AllowOptions) params() []param {
+	var ps []param
+
+	for _, f := range o.fields() {
+		if *f.value != nil {
+			ps = append(ps, boolParam(f.name, **f.value))
+		}
+	}
+
+	return ps
+}
+
+// mounts returns the first allow.mount* parameter enabled, or "".
+func (o *AllowOptions) mounts() string {
+	for _, f := range o.fields() {
+		if strings.HasPrefix(f.name, "allow.mount") && *f.value != nil && **f.value {
+			return f.name
+		}
+	}
+
+	return ""
+}
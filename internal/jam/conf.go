@@ -0,0 +1,659 @@
+package jam
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// param is a resolved jail.conf parameter. A nil values slice denotes a
+// parameter written without a value, e.g. "persist;".
+type param struct {
+	name   string
+	values []string
+}
+
+// boolParams lists the boolean parameters jam understands. They may also be
+// written with a "no" prefix on their last component, e.g. "mount.nodevfs".
+var boolParams = func() map[string]bool {
+	m := map[string]bool{
+		"persist":       true,
+		"exec.clean":    true,
+		"mount.devfs":   true,
+		"mount.fdescfs": true,
+		"mount.procfs":  true,
+		"ip4.saddrsel":  true,
+		"ip6.saddrsel":  true,
+	}
+
+	for _, f := range new(AllowOptions).fields() {
+		m[f.name] = true
+	}
+
+	return m
+}()
+
+// boolParam renders b as a valueless parameter, negating name when false.
+func boolParam(name string, b bool) param {
+	if !b {
+		i := strings.LastIndexByte(name, '.') + 1
+		name = name[:i] + "no" + name[i:]
+	}
+
+	return param{name: name}
+}
+
+// normalizeBool rewrites a negated boolean such as "nopersist" to its
+// positive name and an explicit false value.
+func normalizeBool(p param) param {
+	i := strings.LastIndexByte(p.name, '.') + 1
+
+	if !strings.HasPrefix(p.name[i:], "no") {
+		return p
+	}
+
+	name := p.name[:i] + p.name[i+2:]
+	if !boolParams[name] || p.values != nil {
+		return p
+	}
+
+	return param{name: name, values: []string{"false"}}
+}
+
+func parseBool(p param) (bool, error) {
+	if p.values == nil {
+		return true, nil
+	}
+
+	if len(p.values) == 1 {
+		switch strings.ToLower(p.values[0]) {
+		case "true", "1", "yes", "on":
+			return true, nil
+		case "false", "0", "no", "off":
+			return false, nil
+		}
+	}
+
+	return false, fmt.Errorf("%s: invalid boolean %q", p.name, strings.Join(p.values, ","))
+}
+
+// single returns the only value of p, reporting false when p has zero or
+// several values and so cannot be stored in a string field.
+func single(p param) (string, bool) {
+	if len(p.values) != 1 {
+		return "", false
+	}
+
+	return p.values[0], true
+}
+
+func fromParams(name string, params []param) (*CreateOptions, error) {
+	// Adopted keeps parsed jails exactly as written instead of picking up
+	// DefaultSecurityOptions when rendered again.
+	o := &CreateOptions{Name: name, Adopted: true, Security: new(SecurityOptions)}
+
+	host := func() *HostOptions {
+		if o.Host == nil {
+			o.Host = new(HostOptions)
+		}
+
+		return o.Host
+	}
+
+	execOpts := func() *ExecOptions {
+		if o.Exec == nil {
+			o.Exec = new(ExecOptions)
+		}
+
+		return o.Exec
+	}
+
+	ip4 := func() *IPv4Options {
+		if o.IPv4 == nil {
+			o.IPv4 = new(IPv4Options)
+		}
+
+		return o.IPv4
+	}
+
+	ip6 := func() *IPv6Options {
+		if o.IPv6 == nil {
+			o.IPv6 = new(IPv6Options)
+		}
+
+		return o.IPv6
+	}
+
+	mount := func() *MountOptions {
+		if o.Mount == nil {
+			o.Mount = new(MountOptions)
+		}
+
+		return o.Mount
+	}
+
+	allow := func() *AllowOptions {
+		if o.Allow == nil {
+			o.Allow = new(AllowOptions)
+		}
+
+		return o.Allow
+	}
+
+	vnet := func() *VNetOptions {
+		if o.VNet == nil {
+			o.VNet = new(VNetOptions)
+		}
+
+		return o.VNet
+	}
+
+	for _, p := range params {
+		if boolParams[p.name] {
+			b, err := parseBool(p)
+			if err != nil {
+				return nil, fmt.Errorf("jail %s: %w", name, err)
+			}
+
+			switch p.name {
+			case "persist":
+				o.Persist = b
+			case "ip4.saddrsel":
+				ip4().SAddrSel = &b
+			case "ip6.saddrsel":
+				ip6().SAddrSel = &b
+			case "exec.clean":
+				execOpts().Clean = b
+			case "mount.devfs":
+				mount().DevFS = b
+				mount().NoDevFS = !b
+			case "mount.fdescfs":
+				mount().FdescFS = b
+			case "mount.procfs":
+				mount().ProcFS = b
+			default:
+				if f := allow().field(p.name); f != nil {
+					*f = &b
+				}
+			}
+
+			continue
+		}
+
+		if isSecurity, err := o.Security.set(p); err != nil {
+			return nil, fmt.Errorf("jail %s: %w", name, err)
+		} else if isSecurity {
+			continue
+		}
+
+		v, ok := single(p)
+
+		switch {
+		case p.name == "path" && ok:
+			o.Path = v
+		case p.name == "interface" && ok:
+			o.Interface = v
+		case p.name == "host" && ok:
+			host().Host = v
+		case p.name == "host.hostname" && ok:
+			host().Hostname = v
+		case p.name == "ip4" && ok:
+			ip4().Mode = IPMode(v)
+		case p.name == "ip4.addr" && p.values != nil:
+			ip4().Addr = p.values
+		case p.name == "ip6" && ok:
+			ip6().Mode = IPMode(v)
+		case p.name == "ip6.addr" && p.values != nil:
+			ip6().Addr = p.values
+		case ok && new(ExecOptions).field(p.name) != nil:
+			*execOpts().field(p.name) = v
+		case p.name == "vnet" && (p.values == nil || v == "new"):
+			vnet().Enable = true
+		case p.name == "vnet" && v == "inherit":
+			vnet().Enable = false
+		case p.name == "mount.fstab" && ok:
+			mount().FStab = v
+		case p.name == "vnet.interface" && ok:
+			vnet().Interface = v
+		default:
+			if o.Params == nil {
+				o.Params = make(map[string][]string)
+			}
+
+			o.Params[p.name] = p.values
+		}
+	}
+
+	return o, nil
+}
+
+// field returns the string field backing an exec.* hook parameter, or nil.
+func (o *ExecOptions) field(name string) *string {
+	switch name {
+	case "exec.prestart":
+		return &o.PreStart
+	case "exec.start":
+		return &o.Start
+	case "exec.poststart":
+		return &o.PostStart
+	case "exec.prestop":
+		return &o.PreStop
+	case "exec.stop":
+		return &o.Stop
+	case "exec.poststop":
+		return &o.PostStop
+	}
+
+	return nil
+}
+
+// params returns the jail.conf parameters for o in a fixed order, followed
+// by the entries of o.Params sorted by name.
+func (o CreateOptions) params() []param {
+	ps := o.fieldParams()
+
+	names := make([]string, 0, len(o.Params))
+	for name := range o.Params {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		ps = append(ps, param{name: name, values: o.Params[name]})
+	}
+
+	return ps
+}
+
+// fieldParams returns the parameters rendered from the dedicated fields of
+// o and the defaults.
+func (o CreateOptions) fieldParams() []param {
+	var ps []param
+
+	set := func(name string, values ...string) {
+		ps = append(ps, param{name: name, values: values})
+	}
+
+	str := func(name, v string) {
+		if v != "" {
+			set(name, v)
+		}
+	}
+
+	flag := func(name string, b bool) {
+		if b {
+			set(name)
+		}
+	}
+
+	if o.Mount != nil {
+		flag("mount.devfs", o.Mount.DevFS)
+		flag("mount.nodevfs", o.Mount.NoDevFS)
+		flag("mount.fdescfs", o.Mount.FdescFS)
+		flag("mount.procfs", o.Mount.ProcFS)
+
+		if len(o.Mount.Entries) > 0 {
+			set("mount.fstab", o.fstabFilePath())
+		} else {
+			str("mount.fstab", o.Mount.FStab)
+		}
+	}
+
+	if o.VNet != nil {
+		if o.VNet.managed() {
+			_, jailIf := epair(o.Name)
+
+			set("vnet")
+			set("vnet.interface", jailIf)
+		} else {
+			flag("vnet", o.VNet.Enable)
+			str("vnet.interface", o.VNet.Interface)
+		}
+	}
+
+	str("interface", o.Interface)
+
+	if o.Host != nil {
+		str("host", o.Host.Host)
+		str("host.hostname", o.Host.Hostname)
+	}
+
+	if o.IPv4 != nil {
+		ps = append(ps, o.IPv4.params("ip4")...)
+	}
+
+	if o.IPv6 != nil {
+		ps = append(ps, o.IPv6.params("ip6")...)
+	}
+
+	str("path", o.Path)
+
+	hooks := make(map[string][]string)
+
+	if o.VNet != nil && o.VNet.managed() {
+		hooks["exec.start"] = o.VNet.startCommands(o.Name)
+	}
+
+	for _, name := range []string{
+		"exec.prestart",
+		"exec.start",
+		"exec.poststart",
+		"exec.prestop",
+		"exec.stop",
+		"exec.poststop",
+	} {
+		values := hooks[name]
+
+		if o.Exec != nil && *o.Exec.field(name) != "" {
+			values = append(values, *o.Exec.field(name))
+		}
+
+		if len(values) > 0 {
+			set(name, values...)
+		}
+	}
+
+	if o.Exec != nil {
+		flag("exec.clean", o.Exec.Clean)
+	}
+
+	if o.Allow != nil {
+		ps = append(ps, o.Allow.params()...)
+	}
+
+	security := o.Security
+	if !o.Adopted {
+		security = security.withDefaults()
+	}
+
+	if security != nil {
+		ps = append(ps, security.params()...)
+	}
+
+	flag("persist", o.Persist)
+
+	return ps
+}
+
+// paramFields maps the parameters of fieldParams to the field setting them.
+var paramFields = func() map[string]string {
+	m := map[string]string{
+		"path":           "Path",
+		"interface":      "Interface",
+		"persist":        "Persist",
+		"host":           "Host.Host",
+		"host.hostname":  "Host.Hostname",
+		"ip4":            "IPv4.Mode",
+		"ip4.addr":       "IPv4.Addr",
+		"ip4.saddrsel":   "IPv4.SAddrSel",
+		"ip6":            "IPv6.Mode",
+		"ip6.addr":       "IPv6.Addr",
+		"ip6.saddrsel":   "IPv6.SAddrSel",
+		"exec.prestart":  "Exec.PreStart",
+		"exec.start":     "Exec.Start",
+		"exec.poststart": "Exec.PostStart",
+		"exec.prestop":   "Exec.PreStop",
+		"exec.stop":      "Exec.Stop",
+		"exec.poststop":  "Exec.PostStop",
+		"exec.clean":     "Exec.Clean",
+		"mount.devfs":    "Mount.DevFS",
+		"mount.fdescfs":  "Mount.FdescFS",
+		"mount.procfs":   "Mount.ProcFS",
+		"mount.fstab":    "Mount.FStab",
+		"vnet":           "VNet",
+		"vnet.interface": "VNet.Interface",
+		"osrelease":      "Security.OSRelease",
+	}
+
+	for _, f := range new(AllowOptions).fields() {
+		m[f.name] = "Allow." + f.field
+	}
+
+	sec := new(SecurityOptions)
+
+	for _, f := range sec.ints() {
+		m[f.name] = "Security." + f.field
+	}
+
+	for _, f := range sec.modes() {
+		m[f.name] = "Security." + f.field
+	}
+
+	return m
+}()
+
+func (o CreateOptions) validate() error {
+	if err := validateName(o.Name); err != nil {
+		return err
+	}
+
+	if o.IPv4 != nil {
+		if err := o.IPv4.validate("ip4", netip.Addr.Is4); err != nil {
+			return err
+		}
+	}
+
+	if o.IPv6 != nil {
+		if err := o.IPv6.validate("ip6", isIPv6); err != nil {
+			return err
+		}
+	}
+
+	if o.Security != nil {
+		if err := o.Security.validate(); err != nil {
+			return err
+		}
+	}
+
+	// jail(8) ignores allow.mount* unless enforce_statfs is below 2,
+	// which is also its default and ours. It does not complain, so
+	// adopted configurations are left alone.
+	if o.Allow != nil && !o.Adopted {
+		if name := o.Allow.mounts(); name != "" {
+			if sec := o.Security.withDefaults(); *sec.EnforceStatFS >= 2 {
+				return fmt.Errorf("%s requires enforce_statfs below 2", name)
+			}
+		}
+	}
+
+	// A key of Params that a field or default already renders would be
+	// written twice.
+	if len(o.Params) > 0 {
+		rendered := make(map[string]bool)
+		for _, p := range o.fieldParams() {
+			rendered[normalizeBool(p).name] = true
+		}
+
+		names := make([]string, 0, len(o.Params))
+		for name := range o.Params {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			if n := normalizeBool(param{name: name}).name; rendered[n] {
+				return fmt.Errorf("params: %s is set by %s", name, paramFields[n])
+			}
+		}
+	}
+
+	for _, l := range o.Limits {
+		if err := l.validate(); err != nil {
+			return err
+		}
+	}
+
+	if o.VNet != nil {
+		if err := o.VNet.validate(); err != nil {
+			return err
+		}
+
+		// A vnet jail has its own network stack; ip4.addr and ip6.addr
+		// only restrict the host's.
+		if o.VNet.enabled() {
+			if o.IPv4 != nil && len(o.IPv4.Addr) > 0 {
+				return errors.New("vnet: ip4.addr cannot be set on a vnet jail")
+			}
+
+			if o.IPv6 != nil && len(o.IPv6.Addr) > 0 {
+				return errors.New("vnet: ip6.addr cannot be set on a vnet jail")
+			}
+		}
+	}
+
+	if o.Mount != nil {
+		if len(o.Mount.Entries) > 0 && o.Mount.FStab != "" {
+			return errors.New("mount: entries and an external fstab are mutually exclusive")
+		}
+
+		if len(o.Mount.Entries) > 0 && o.Path == "" {
+			return errors.New("mount: entries require a jail path")
+		}
+
+		for _, e := range o.Mount.Entries {
+			if err := e.validate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if o.CPUSet != nil {
+		if err := o.CPUSet.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range o.PortForward {
+		if err := f.validate(); err != nil {
+			return err
+		}
+	}
+
+	for name := range o.Params {
+		if err := validateParamName(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateName(name string) error {
+	if name == "" {
+		return errors.New("jail name is required")
+	}
+
+	if strings.ContainsAny(name, "./") {
+		return fmt.Errorf("invalid jail name %q", name)
+	}
+
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("invalid jail name %q", name)
+		}
+	}
+
+	return nil
+}
+
+func validateParamName(name string) error {
+	if name == "" || strings.HasPrefix(name, "$") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid parameter name %q", name)
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !isVarChar(c) && c != '.' {
+			return fmt.Errorf("invalid parameter name %q", name)
+		}
+	}
+
+	return nil
+}
+
+// writeBlock writes a jail block. Every value is passed through quote so
+// that user supplied strings cannot terminate the parameter or the block.
+func writeBlock(w io.Writer, name string, params []param) error {
+	var sb strings.Builder
+
+	sb.WriteString(quote(name))
+	sb.WriteString(" {\n")
+
+	for _, p := range params {
+		sb.WriteString("\t")
+		sb.WriteString(p.name)
+
+		if p.values != nil {
+			sb.WriteString(" = ")
+
+			for i, v := range p.values {
+				if i > 0 {
+					sb.WriteString(", ")
+				}
+
+				sb.WriteString(quote(v))
+			}
+		}
+
+		sb.WriteString(";\n")
+	}
+
+	sb.WriteString("}\n")
+
+	_, err := io.WriteString(w, sb.String())
+
+	return err
+}
+
+// quote returns s as a jail.conf string. Values made only of characters
+// that cannot start a comment, a variable or a delimiter are written bare;
+// everything else is double quoted with '"', '\' and '$' escaped.
+func quote(s string) string {
+	if isBare(s) {
+		return s
+	}
+
+	var sb strings.Builder
+
+	sb.WriteByte('"')
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', '$':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	sb.WriteByte('"')
+
+	return sb.String()
+}
+
+func isBare(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !isVarChar(c) && strings.IndexByte(".:|@%+-", c) < 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,387 @@
+package jam
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func boolp(b bool) *bool {
+	return &b
+}
+
+var configTests = []struct {
+	name string
+	opts CreateOptions
+}{
+	{
+		name: "minimal",
+		opts: CreateOptions{
+			Name: "www",
+			Path: "/usr/jails/www",
+		},
+	},
+	{
+		name: "escaping",
+		opts: CreateOptions{
+			Name:    "web-1",
+			Path:    "/usr/jails/web 1",
+			Persist: true,
+			Host: &HostOptions{
+				Hostname: `web"1".example.org`,
+			},
+			IPv4: &IPv4Options{IPOptions{
+				Addr:     []string{"em0|192.0.2.10/24", "192.0.2.11"},
+				SAddrSel: boolp(false),
+			}},
+			IPv6: &IPv6Options{IPOptions{
+				Addr: []string{"em0|2001:db8::10/64", "2001:db8::11"},
+			}},
+			Exec: &ExecOptions{
+				Start: "/bin/sh /etc/rc; echo \"started $name\"\nlogger done",
+				Stop:  `/bin/sh /etc/rc.shutdown \$HOME`,
+				Clean: true,
+			},
+			Allow: &AllowOptions{
+				RawSockets: boolp(true),
+			},
+			Security: &SecurityOptions{
+				DevFSRuleset: intp(10),
+			},
+			Params: map[string][]string{
+				"zfs.mount":        nil,
+				"osrelease.foo":    {"a;b"},
+				"exec.system_user": {"root"},
+				"exec.jail_user":   {"www"},
+			},
+		},
+	},
+	{
+		// Fields left unset keep their defaults.
+		name: "security",
+		opts: CreateOptions{
+			Name: "db",
+			Path: "/usr/jails/db",
+			Security: &SecurityOptions{
+				SecureLevel: intp(3),
+				SysVShm:     SysVNew,
+			},
+		},
+	},
+}
+
+func intp(i int) *int {
+	return &i
+}
+
+func TestBuildConfigGolden(t *testing.T) {
+	for _, tt := range configTests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renderConfig(t, tt.opts)
+			golden := filepath.Join("testdata", tt.name+".conf")
+
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Errorf("buildConfig() =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	for _, tt := range configTests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := renderConfig(t, tt.opts)
+
+			parsed, err := ParseConfig(bytes.NewReader(text))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(parsed) != 1 {
+				t.Fatalf("ParseConfig() returned %d jails, want 1", len(parsed))
+			}
+
+			o := parsed[0]
+
+			if o.Name != tt.opts.Name || o.Path != tt.opts.Path || o.Persist != tt.opts.Persist {
+				t.Errorf("ParseConfig() = %+v, want %+v", o, tt.opts)
+			}
+
+			if !reflect.DeepEqual(o.Host, tt.opts.Host) {
+				t.Errorf("Host = %+v, want %+v", o.Host, tt.opts.Host)
+			}
+
+			if !reflect.DeepEqual(o.IPv4, tt.opts.IPv4) || !reflect.DeepEqual(o.IPv6, tt.opts.IPv6) {
+				t.Errorf("IPv4 = %+v, IPv6 = %+v, want %+v, %+v", o.IPv4, o.IPv6, tt.opts.IPv4, tt.opts.IPv6)
+			}
+
+			if !reflect.DeepEqual(o.Exec, tt.opts.Exec) {
+				t.Errorf("Exec = %+v, want %+v", o.Exec, tt.opts.Exec)
+			}
+
+			if again := renderConfig(t, *o); !bytes.Equal(again, text) {
+				t.Errorf("rendering the parsed jail again gives\n%s\nwant\n%s", again, text)
+			}
+		})
+	}
+}
+
+func TestParseConfigGolden(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "jail.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	jails, err := ParseConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+
+	for _, o := range jails {
+		got.Write(renderConfig(t, *o))
+
+		// What we write has to read back the same.
+		again, err := ParseConfig(bytes.NewReader(renderConfig(t, *o)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(again) != 1 || !reflect.DeepEqual(again[0], o) {
+			t.Errorf("jail %s does not survive a round trip: %+v, want %+v", o.Name, again, o)
+		}
+	}
+
+	golden := filepath.Join("testdata", "jail.conf.golden")
+
+	if *update {
+		if err := os.WriteFile(golden, got.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("ParseConfig() rendered\n%s\nwant\n%s", got.Bytes(), want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts CreateOptions
+		err  string
+	}{
+		{
+			name: "allow.mount with the default enforce_statfs",
+			opts: CreateOptions{Name: "a", Allow: &AllowOptions{MountNullFS: boolp(true)}},
+			err:  "allow.mount.nullfs requires enforce_statfs below 2",
+		},
+		{
+			name: "allow.mount with enforce_statfs left unset",
+			opts: CreateOptions{
+				Name:     "a",
+				Allow:    &AllowOptions{Mount: boolp(true)},
+				Security: &SecurityOptions{SecureLevel: intp(1)},
+			},
+			err: "allow.mount requires enforce_statfs below 2",
+		},
+		{
+			name: "allow.mount with enforce_statfs 1",
+			opts: CreateOptions{
+				Name:     "a",
+				Allow:    &AllowOptions{Mount: boolp(true)},
+				Security: &SecurityOptions{EnforceStatFS: intp(1)},
+			},
+		},
+		{
+			name: "params overriding a default",
+			opts: CreateOptions{Name: "a", Params: map[string][]string{"devfs_ruleset": {"10"}}},
+			err:  "params: devfs_ruleset is set by Security.DevFSRuleset",
+		},
+		{
+			name: "params overriding a field",
+			opts: CreateOptions{Name: "a", Path: "/j", Params: map[string][]string{"path": {"/k"}}},
+			err:  "params: path is set by Path",
+		},
+		{
+			name: "params negating a field",
+			opts: CreateOptions{
+				Name:   "a",
+				Allow:  &AllowOptions{RawSockets: boolp(true)},
+				Params: map[string][]string{"allow.noraw_sockets": nil},
+			},
+			err: "params: allow.noraw_sockets is set by Allow.RawSockets",
+		},
+		{
+			name: "params for an unset field",
+			opts: CreateOptions{Name: "a", Params: map[string][]string{"host.hostname": {"a.example.org"}}},
+		},
+		{
+			name: "adopted allow.mount",
+			opts: CreateOptions{Name: "a", Adopted: true, Allow: &AllowOptions{MountNullFS: boolp(true)}},
+		},
+		{
+			name: "vnet with ip4.addr",
+			opts: CreateOptions{
+				Name: "a",
+				VNet: &VNetOptions{Enable: true, Interface: "em1"},
+				IPv4: &IPv4Options{IPOptions{Addr: []string{"10.0.0.2"}}},
+			},
+			err: "vnet: ip4.addr cannot be set on a vnet jail",
+		},
+		{
+			name: "bridged vnet with ip6.addr",
+			opts: CreateOptions{
+				Name: "a",
+				VNet: &VNetOptions{Bridge: "bridge0", Addr: []string{"fd00::2/64"}},
+				IPv6: &IPv6Options{IPOptions{Addr: []string{"fd00::3"}}},
+			},
+			err: "vnet: ip6.addr cannot be set on a vnet jail",
+		},
+		{
+			name: "vnet disabled with ip4.addr",
+			opts: CreateOptions{
+				Name: "a",
+				VNet: &VNetOptions{},
+				IPv4: &IPv4Options{IPOptions{Addr: []string{"10.0.0.2"}}},
+			},
+		},
+		{
+			name: "vnet addresses without a bridge",
+			opts: CreateOptions{Name: "a", VNet: &VNetOptions{Enable: true, Addr: []string{"10.0.0.2/24"}}},
+			err:  "vnet: addresses require a bridge",
+		},
+		{
+			name: "vnet bad cidr",
+			opts: CreateOptions{Name: "a", VNet: &VNetOptions{Bridge: "bridge0", Addr: []string{"10.0.0.2/33"}}},
+			err:  `vnet: invalid address "10.0.0.2/33"`,
+		},
+		{
+			name: "vnet bad default router",
+			opts: CreateOptions{Name: "a", VNet: &VNetOptions{Bridge: "bridge0", DefaultRouter: []string{"10.0.0.1/24"}}},
+			err:  `vnet: invalid default router "10.0.0.1/24"`,
+		},
+		{
+			name: "vnet interface and bridge",
+			opts: CreateOptions{Name: "a", VNet: &VNetOptions{Interface: "em1", Bridge: "bridge0"}},
+			err:  "vnet: interface and bridge are mutually exclusive",
+		},
+		{
+			name: "ip4 bad cidr",
+			opts: CreateOptions{Name: "a", IPv4: &IPv4Options{IPOptions{Addr: []string{"em0|10.0.0.2/40"}}}},
+			err:  `ip4.addr: invalid address "em0|10.0.0.2/40"`,
+		},
+		{
+			name: "ip4 with a v6 address",
+			opts: CreateOptions{Name: "a", IPv4: &IPv4Options{IPOptions{Addr: []string{"fd00::2"}}}},
+			err:  `ip4.addr: "fd00::2" is not an ip4 address`,
+		},
+		{
+			name: "ip6 with a v4 address",
+			opts: CreateOptions{Name: "a", IPv6: &IPv6Options{IPOptions{Addr: []string{"10.0.0.2"}}}},
+			err:  `ip6.addr: "10.0.0.2" is not an ip6 address`,
+		},
+		{
+			name: "ip6 without a mode",
+			opts: CreateOptions{Name: "a", IPv6: &IPv6Options{IPOptions{Addr: []string{"em0|fd00::2/64"}}}},
+		},
+		{
+			name: "ip6 inherit with addresses",
+			opts: CreateOptions{Name: "a", IPv6: &IPv6Options{IPOptions{Mode: IPInherit, Addr: []string{"fd00::2"}}}},
+			err:  `ip6: addresses cannot be set with mode "inherit"`,
+		},
+		{
+			name: "ip6 invalid mode",
+			opts: CreateOptions{Name: "a", IPv6: &IPv6Options{IPOptions{Mode: "shared"}}},
+			err:  `ip6: invalid mode "shared"`,
+		},
+		{
+			name: "ip6 bad interface",
+			opts: CreateOptions{Name: "a", IPv6: &IPv6Options{IPOptions{Addr: []string{"|fd00::2"}}}},
+			err:  `ip6.addr: invalid interface in "|fd00::2"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.validate()
+
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("validate() error = %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("validate() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"em0|10.0.0.1", "em0|10.0.0.1"},
+		{"/usr/jails", `"/usr/jails"`},
+		{"", `""`},
+		{"two words", `"two words"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"$var", `"\$var"`},
+		{`back\slash`, `"back\\slash"`},
+		{"a;b", `"a;b"`},
+		{"line\nbreak\ttab\rcr", `"line\nbreak\ttab\rcr"`},
+		{"{braces}", `"{braces}"`},
+	}
+
+	for _, tt := range tests {
+		if got := quote(tt.in); got != tt.want {
+			t.Errorf("quote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func renderConfig(t *testing.T, o CreateOptions) []byte {
+	t.Helper()
+
+	r, err := o.buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
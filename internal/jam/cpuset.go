@@ -0,0 +1,181 @@
+package jam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	cpusetCmd = "/bin/cpuset"
+
+	// maxCPU mirrors the kernel's CPU_MAXSIZE on amd64 and arm64.
+	maxCPU = 1024
+)
+
+// CPUList is a set of CPU ids, written in cpuset(1) list syntax such as
+// "0-3,6".
+type CPUList []int
+
+// ParseCPUList parses a cpuset(1) list. The result is sorted and free of
+// duplicates.
+func ParseCPUList(s string) (CPUList, error) {
+	seen := make(map[int]bool)
+
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+
+		lo, hi, isRange := strings.Cut(item, "-")
+		if !isRange {
+			hi = lo
+		}
+
+		first, err := parseCPU(lo)
+		if err != nil {
+			return nil, fmt.Errorf("cpuset: invalid list %q: %w", s, err)
+		}
+
+		last, err := parseCPU(hi)
+		if err != nil {
+			return nil, fmt.Errorf("cpuset: invalid list %q: %w", s, err)
+		}
+
+		if last < first {
+			return nil, fmt.Errorf("cpuset: invalid range %q", item)
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			seen[cpu] = true
+		}
+	}
+
+	l := make(CPUList, 0, len(seen))
+	for cpu := range seen {
+		l = append(l, cpu)
+	}
+
+	sort.Ints(l)
+
+	return l, nil
+}
+
+func parseCPU(s string) (int, error) {
+	cpu, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if cpu < 0 || cpu >= maxCPU {
+		return 0, fmt.Errorf("cpu %d out of range [0, %d)", cpu, maxCPU)
+	}
+
+	return cpu, nil
+}
+
+// String returns l in cpuset(1) list syntax, collapsing consecutive ids into
+// ranges.
+func (l CPUList) String() string {
+	cpus := append([]int(nil), l...)
+	sort.Ints(cpus)
+
+	var parts []string
+
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] <= cpus[j]+1 {
+			j++
+		}
+
+		if cpus[i] == cpus[j] {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", cpus[i], cpus[j]))
+		}
+
+		i = j + 1
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (l CPUList) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *CPUList) UnmarshalText(b []byte) error {
+	parsed, err := ParseCPUList(string(b))
+	if err != nil {
+		return err
+	}
+
+	*l = parsed
+
+	return nil
+}
+
+// CPUSetOptions pins a jail to a set of CPUs and, optionally, a NUMA memory
+// domain. DomainPolicy is one of first-touch, round-robin, prefer or
+// interleave and defaults to prefer.
+type CPUSetOptions struct {
+	CPUs         CPUList `json:"CPUs"`
+	Domain       *int    `json:"Domain,omitempty"`
+	DomainPolicy string  `json:"DomainPolicy,omitempty"`
+}
+
+func (o *CPUSetOptions) validate() error {
+	if len(o.CPUs) == 0 {
+		return errors.New("cpuset: no cpus")
+	}
+
+	for _, cpu := range o.CPUs {
+		if cpu < 0 || cpu >= maxCPU {
+			return fmt.Errorf("cpuset: cpu %d out of range [0, %d)", cpu, maxCPU)
+		}
+	}
+
+	if o.Domain == nil {
+		if o.DomainPolicy != "" {
+			return errors.New("cpuset: domain policy without a domain")
+		}
+
+		return nil
+	}
+
+	if *o.Domain < 0 {
+		return fmt.Errorf("cpuset: invalid domain %d", *o.Domain)
+	}
+
+	switch o.DomainPolicy {
+	case "", "first-touch", "round-robin", "prefer", "interleave":
+	default:
+		return fmt.Errorf("cpuset: invalid domain policy %q", o.DomainPolicy)
+	}
+
+	return nil
+}
+
+func (o *CPUSetOptions) args(jid int64) []string {
+	args := []string{"-j", strconv.FormatInt(jid, 10), "-l", o.CPUs.String()}
+
+	if o.Domain != nil {
+		policy := o.DomainPolicy
+		if policy == "" {
+			policy = "prefer"
+		}
+
+		args = append(args, "-n", policy+":"+strconv.Itoa(*o.Domain))
+	}
+
+	return args
+}
+
+func (j *Jail) applyCPUSet(ctx context.Context) error {
+	if j.Config.CPUSet == nil {
+		return nil
+	}
+
+	return j.runCommand(ctx, cpusetCmd, j.Config.CPUSet.args(j.ID))
+}
@@ -0,0 +1,89 @@
+package jam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    CPUList
+		wantErr bool
+	}{
+		{in: "0", want: CPUList{0}},
+		{in: "0-3", want: CPUList{0, 1, 2, 3}},
+		{in: "0-1,4,6-7", want: CPUList{0, 1, 4, 6, 7}},
+		{in: " 2 , 0 ", want: CPUList{0, 2}},
+		{in: "3,3,1", want: CPUList{1, 3}},
+		{in: "0-4,2-6", want: CPUList{0, 1, 2, 3, 4, 5, 6}},
+		{in: "5,0-2,1", want: CPUList{0, 1, 2, 5}},
+		{in: "2-2", want: CPUList{2}},
+		{in: "1023", want: CPUList{1023}},
+		{in: "", wantErr: true},
+		{in: "1-", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "a", wantErr: true},
+		{in: "3-1", wantErr: true},
+		{in: "0,,1", wantErr: true},
+		{in: "1-2-3", wantErr: true},
+		{in: "1024", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseCPUList(tt.in)
+
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseCPUList(%q) = %v, want an error", tt.in, got)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseCPUList(%q) error = %v", tt.in, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseCPUList(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCPUListString(t *testing.T) {
+	tests := []struct {
+		in   CPUList
+		want string
+	}{
+		{CPUList{}, ""},
+		{CPUList{0}, "0"},
+		{CPUList{0, 1, 2, 3}, "0-3"},
+		{CPUList{0, 1, 4, 6, 7}, "0-1,4,6-7"},
+		{CPUList{7, 6, 0, 1, 1}, "0-1,6-7"},
+		{CPUList{1, 3, 5}, "1,3,5"},
+	}
+
+	for _, tt := range tests {
+		got := tt.in.String()
+		if got != tt.want {
+			t.Errorf("%v.String() = %q, want %q", []int(tt.in), got, tt.want)
+		}
+
+		if len(tt.in) == 0 {
+			continue
+		}
+
+		// Parsing the string back yields the sorted set.
+		again, err := ParseCPUList(got)
+		if err != nil {
+			t.Errorf("ParseCPUList(%q) error = %v", got, err)
+			continue
+		}
+
+		if again.String() != got {
+			t.Errorf("ParseCPUList(%q).String() = %q", got, again.String())
+		}
+	}
+}
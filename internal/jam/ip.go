@@ -0,0 +1,81 @@
+package jam
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+func (o IPOptions) params(family string) []param {
+	var ps []param
+
+	if o.Mode != "" {
+		ps = append(ps, param{name: family, values: []string{string(o.Mode)}})
+	}
+
+	if len(o.Addr) > 0 {
+		ps = append(ps, param{name: family + ".addr", values: o.Addr})
+	}
+
+	if o.SAddrSel != nil {
+		ps = append(ps, boolParam(family+".saddrsel", *o.SAddrSel))
+	}
+
+	return ps
+}
+
+func (o IPOptions) validate(family string, inFamily func(netip.Addr) bool) error {
+	switch o.Mode {
+	case "", IPNew:
+	case IPInherit, IPDisable:
+		if len(o.Addr) > 0 {
+			return fmt.Errorf("%s: addresses cannot be set with mode %q", family, o.Mode)
+		}
+	default:
+		return fmt.Errorf("%s: invalid mode %q", family, o.Mode)
+	}
+
+	for _, s := range o.Addr {
+		_, prefix, err := ParseIPAddr(s)
+		if err != nil {
+			return fmt.Errorf("%s.addr: %w", family, err)
+		}
+
+		if !inFamily(prefix.Addr()) {
+			return fmt.Errorf("%s.addr: %q is not an %s address", family, s, family)
+		}
+	}
+
+	return nil
+}
+
+func isIPv6(a netip.Addr) bool {
+	return a.Is6() && !a.Is4In6()
+}
+
+// ParseIPAddr splits an ip4.addr or ip6.addr entry of the form
+// [interface|]address[/prefix]. A bare address yields a single-host prefix.
+func ParseIPAddr(s string) (string, netip.Prefix, error) {
+	iface, addr, found := strings.Cut(s, "|")
+	if !found {
+		iface, addr = "", s
+	} else if iface == "" || strings.ContainsAny(iface, " \t") {
+		return "", netip.Prefix{}, fmt.Errorf("invalid interface in %q", s)
+	}
+
+	if strings.Contains(addr, "/") {
+		prefix, err := netip.ParsePrefix(addr)
+		if err != nil {
+			return "", netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+		}
+
+		return iface, prefix, nil
+	}
+
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		return "", netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+	}
+
+	return iface, netip.PrefixFrom(a, a.BitLen()), nil
+}
@@ -6,39 +6,42 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 )
 
-var fm = template.FuncMap{
-	"join": func(s []string) string {
-		return strings.Join(s, ", ")
-	},
-}
-
-type State int
+const DefaultStartTimeout = 5 * time.Minute
 
-const (
-	StateRunning State = iota
-)
+// Releaser gives back resources held on behalf of a jail, such as address
+// leases.
+type Releaser interface {
+	Release(jail string) error
+}
 
 type Jail struct {
-	ID        int64
-	Name      string
-	CreatedAt time.Time
-	State     State
-	Config    *CreateOptions
-	cmd       *exec.Cmd
-	stdin     *bytes.Buffer
-	stdout    *bytes.Buffer
-	stderr    *bytes.Buffer
+	ID        int64          `json:"ID"`
+	Name      string         `json:"Name"`
+	CreatedAt time.Time      `json:"CreatedAt"`
+	State     State          `json:"State"`
+	Config    *CreateOptions `json:"Config"`
+	Runner    Runner         `json:"-"`
+	Firewall  *PF            `json:"-"`
+	// Leases, when set, is released once the jail is removed.
+	Leases Releaser `json:"-"`
+	// StartTimeout bounds how long Start waits for jail(8), including
+	// exec.prestart and exec.start hooks. Zero means DefaultStartTimeout.
+	StartTimeout time.Duration `json:"StartTimeout"`
+	stdin        *bytes.Buffer
+	stdout       *bytes.Buffer
+	stderr       *bytes.Buffer
 }
 
 func (j *Jail) startArgs() []string {
@@ -51,57 +54,253 @@ func (j *Jail) startArgs() []string {
 	}
 }
 
-func (j *Jail) runCommand(cmd string, args []string) error {
-	j.cmd = exec.Command(cmd, args...)
+func (j *Jail) runner() Runner {
+	if j.Runner == nil {
+		return DefaultRunner
+	}
 
-	if err := j.cmd.Run(); err != nil {
-		return err
+	return j.Runner
+}
+
+// runCommand runs cmd with the jail's buffers attached, discarding the output
+// of any previous command.
+func (j *Jail) runCommand(ctx context.Context, cmd string, args []string) error {
+	if j.stdin == nil {
+		j.stdin = new(bytes.Buffer)
+	}
+
+	if j.stdout == nil {
+		j.stdout = new(bytes.Buffer)
+	}
+
+	if j.stderr == nil {
+		j.stderr = new(bytes.Buffer)
 	}
 
-	if !j.cmd.ProcessState.Success() {
-		return errors.New("error running")
+	j.stdout.Reset()
+	j.stderr.Reset()
+
+	err := j.runner().Run(ctx, &Command{
+		Path:   cmd,
+		Args:   args,
+		Stdin:  j.stdin,
+		Stdout: j.stdout,
+		Stderr: j.stderr,
+	})
+	if err != nil {
+		return &CommandError{
+			Path:   cmd,
+			Args:   args,
+			Stderr: j.stderr.String(),
+			Err:    err,
+		}
 	}
 
 	return nil
 }
 
-func (j *Jail) Start() error {
-	if err := j.runCommand("/usr/sbin/jail", j.startArgs()); err != nil {
+func (j *Jail) transition(to State) error {
+	if !j.State.canTransition(to) {
+		return &TransitionError{
+			Name: j.Name,
+			From: j.State,
+			To:   to,
+		}
+	}
+
+	j.State = to
+
+	return nil
+}
+
+func (j *Jail) Start(ctx context.Context) error {
+	if err := j.transition(StateStarting); err != nil {
 		return err
 	}
 
-	out, err := j.cmd.Output()
-	if err != nil {
+	if err := j.createEpair(ctx); err != nil {
+		j.State = StateFailed
 		return err
 	}
 
-	j.ID, err = strconv.ParseInt(string(bytes.TrimSpace(out)), 10, 64)
-	if err != nil {
+	if err := j.start(ctx); err != nil {
+		// jail(8) may have created the jail before failing or timing
+		// out.
+		j.State = StateFailed
+		j.abortStart(ctx)
+
 		return err
 	}
 
+	if err := j.afterStart(ctx); err != nil {
+		j.State = StateFailed
+		j.abortStart(ctx)
+
+		return err
+	}
+
+	return j.transition(StateRunning)
+}
+
+// abortStart tears down whatever a failed Start left behind. Errors are
+// ignored in favour of the one that caused the abort.
+func (j *Jail) abortStart(ctx context.Context) {
+	if err := j.stop(ctx); err == nil {
+		j.ID = 0
+	}
+
+	_ = j.afterStop(ctx)
+}
+
+func (j *Jail) start(ctx context.Context) error {
+	timeout := j.StartTimeout
+	if timeout <= 0 {
+		timeout = DefaultStartTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := j.runCommand(ctx, jailCmd, j.startArgs()); err != nil {
+		return err
+	}
+
+	id, err := parseJID(j.stdout.String())
+	if err != nil {
+		return fmt.Errorf("jail %s: %w", j.Name, err)
+	}
+
+	j.ID = id
+
 	return nil
 }
 
-func (j Jail) save() ([]byte, error) {
-	return nil, errors.New("not implemented")
+// parseJID extracts the jail identifier printed by jail -i. Output of
+// exec.* hooks may be interleaved, so the first line holding only an integer
+// is taken.
+func parseJID(out string) (int64, error) {
+	for _, line := range strings.Split(out, "\n") {
+		id, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+		if err == nil && id > 0 {
+			return id, nil
+		}
+	}
+
+	return 0, errors.New("no jid in jail(8) output")
+}
+
+func (j *Jail) Stop(ctx context.Context) error {
+	if err := j.transition(StateStopping); err != nil {
+		return err
+	}
+
+	if err := j.stop(ctx); err != nil {
+		j.State = StateFailed
+		return err
+	}
+
+	j.ID = 0
+
+	if err := j.afterStop(ctx); err != nil {
+		j.State = StateFailed
+		return err
+	}
+
+	return j.transition(StateStopped)
 }
 
-func (j *Jail) stop() error {
+// stop removes the jail, succeeding if it does not exist.
+func (j *Jail) stop(ctx context.Context) error {
 	args := []string{
 		"-f", j.Config.configFilePath(),
 		"-r",
 		j.Name,
 	}
 
-	cmd := exec.CommandContext(context.Background(), "/usr/sbin/jail", args...)
-	if err := cmd.Run(); err != nil {
+	if err := j.runCommand(ctx, jailCmd, args); err != nil && !isGone(err, "not found") {
 		return err
 	}
 
 	return nil
 }
 
+// afterStart applies host-side settings that need the jail to exist.
+func (j *Jail) afterStart(ctx context.Context) error {
+	if err := j.applyLimits(ctx); err != nil {
+		return err
+	}
+
+	if err := j.applyCPUSet(ctx); err != nil {
+		return err
+	}
+
+	if j.Firewall != nil {
+		return j.Firewall.Add(ctx, j.Config)
+	}
+
+	return nil
+}
+
+// afterStop releases host-side settings once the jail is gone. Every step
+// runs, whatever the others return, and settings that are already gone are
+// not an error.
+func (j *Jail) afterStop(ctx context.Context) error {
+	var errs []error
+
+	if j.Firewall != nil {
+		errs = append(errs, j.Firewall.Remove(ctx, j.Name))
+	}
+
+	errs = append(errs, j.removeLimits(ctx), j.destroyEpair(ctx))
+
+	return errors.Join(errs...)
+}
+
+// Restart stops the jail if it is running, or tears down what a failure
+// left behind, and starts it again.
+func (j *Jail) Restart(ctx context.Context) error {
+	if j.State == StateRunning || j.State == StateFailed {
+		if err := j.Stop(ctx); err != nil {
+			return err
+		}
+	}
+
+	return j.Start(ctx)
+}
+
+// Remove deletes the jail configuration. The jail must not be running.
+func (j *Jail) Remove(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !j.State.canTransition(StateRemoved) {
+		return &TransitionError{
+			Name: j.Name,
+			From: j.State,
+			To:   StateRemoved,
+		}
+	}
+
+	for _, pat := range []string{j.Config.configFilePath(), j.Config.fstabFilePath()} {
+		if err := os.Remove(pat); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	if j.Leases != nil {
+		if err := j.Leases.Release(j.Name); err != nil {
+			return err
+		}
+	}
+
+	return j.transition(StateRemoved)
+}
+
+func (j *Jail) save() ([]byte, error) {
+	return json.Marshal(j)
+}
+
 type CreateOptions struct {
 	Persist   bool          `json:"Persist"`
 	Name      string        `json:"Name"`
@@ -109,11 +308,26 @@ type CreateOptions struct {
 	Path      string        `json:"Path"`
 	Host      *HostOptions  `json:"Host"`
 	IPv4      *IPv4Options  `json:"IP4"`
-	IPv6      *IPv4Options  `json:"IP6"`
+	IPv6      *IPv6Options  `json:"IP6"`
 	Exec      *ExecOptions  `json:"Exec"`
 	Mount     *MountOptions `json:"Mount"`
 	VNet      *VNetOptions  `json:"VNet"`
-	ConfigDir string        `json:"ConfigDir"`
+	Allow     *AllowOptions `json:"Allow"`
+	// Security fields left unset take their DefaultSecurityOptions value.
+	Security *SecurityOptions `json:"Security"`
+	// Adopted marks options that ParseConfig read from an existing
+	// jail.conf. They are rendered without the security defaults and
+	// are not held to checks jail(8) itself does not make.
+	Adopted bool           `json:"Adopted,omitempty"`
+	Limits  []Limit        `json:"Limits,omitempty"`
+	CPUSet  *CPUSetOptions `json:"CPUSet,omitempty"`
+	// PortForward takes effect when the jail has a Firewall.
+	PortForward []PortForward `json:"PortForward,omitempty"`
+	ConfigDir   string        `json:"ConfigDir"`
+	// Params holds parameters without a dedicated field, keyed by their
+	// jail.conf name. A nil value marks a parameter set without a value.
+	// Keys that a field or default already renders are rejected.
+	Params map[string][]string `json:"Params,omitempty"`
 }
 
 func (o CreateOptions) configFilePath() string {
@@ -126,9 +340,16 @@ func (o CreateOptions) configFilePath() string {
 	return filepath.Join(pat, o.Name+".conf")
 }
 
+// MountOptions controls file systems mounted when the jail is created.
+// Entries are written to a fstab next to the jail's configuration file;
+// FStab references an existing one instead.
 type MountOptions struct {
-	DevFS   bool `json:"DevFS"`
-	NoDevFS bool `json:"NoDevFS"`
+	DevFS   bool         `json:"DevFS"`
+	NoDevFS bool         `json:"NoDevFS"`
+	FdescFS bool         `json:"FdescFS"`
+	ProcFS  bool         `json:"ProcFS"`
+	FStab   string       `json:"FStab,omitempty"`
+	Entries []MountEntry `json:"Entries,omitempty"`
 }
 
 type ExecOptions struct {
@@ -141,18 +362,25 @@ type ExecOptions struct {
 	Clean     bool `json:"Clean"`
 }
 
-type VNetOptions struct {
-	Interface string
-	Enable    bool
-}
-
 type HostOptions struct {
 	Host     string
 	Hostname string
 }
 
+// IPMode selects how a jail's ip4 or ip6 network stack is provided.
+type IPMode string
+
+const (
+	IPNew     IPMode = "new"
+	IPInherit IPMode = "inherit"
+	IPDisable IPMode = "disable"
+)
+
+// IPOptions configures one address family. Addr entries take the form
+// [interface|]address[/prefix], as in jail(8).
 type IPOptions struct {
-	SAddrSel string   `json:"SAddrSel"`
+	Mode     IPMode   `json:"Mode,omitempty"`
+	SAddrSel *bool    `json:"SAddrSel,omitempty"`
 	Addr     []string `json:"Addr"`
 }
 
@@ -164,82 +392,16 @@ type IPv6Options struct {
 	IPOptions
 }
 
-type AllowOptions struct{}
-
 func (o CreateOptions) buildConfig() (io.Reader, error) {
-	tmpl := `
-# File created by jamd
-# DO NOT EDIT
-
-{{ .Name }} {
-	{{- if .Mount }}
-	{{ if .DevFS}}
-    mount.devfs;
-	{{ end }}
-	{{ if .NoDevFS}}
-    mount.nodevfs;
-	{{ end }}
-	{{- end }}
-
-	{{- if .VNet }}
-	{{- if .VNet.Enable }}
-	vnet;
-	{{ end }}
-	{{ end }}
-
-	{{- if .Interface }}
-	interface = {{ .Interface }};
-	{{ end }}
-
-	{{- if .Host }}
-    host.hostname  = {{ .Host.Hostname }};
-	{{- end }}
-	{{- if .IP4 }}
-    ip4.addr       = {{join .IP4.Addr }};
-	{{- end }}
-    path           = "{{ .Path }}";
-	{{- if .Exec }}
-	{{- if .Exec.Start }}
-    exec.start     = "{{ .Exec.Start }}";
-	{{ end }}
-	{{- if .Exec.PreStart }}
-    exec.prestart  = "{{ .Exec.PreStart }}";
-	{{ end }}
-	{{- if .Exec.PostStart }}
-    exec.poststart = "{{ .Exec.PostStart }}";
-	{{ end }}
-	{{- if .Exec.Stop }}
-    exec.stop      = "{{ .Exec.Stop }}";
-	{{ end }}
-	{{- if .Exec.PreStop }}
-    exec.prestop   = "{{ .Exec.PreStop }}";
-	{{ end }}
-	{{- if .Exec.PostStop }}
-    exec.poststop  = "{{ .Exec.PostStop }}";
-	{{- end }}
-	{{- if .Exec.Clean }}
-    exec.clean;
-	{{- end }}
-	{{ end }}
-
-	{{- if .Persist }}
-	persist;
-	{{- end }}
-}
-`
-
-	return renderTemplate(o, tmpl)
-}
-
-func renderTemplate(obj CreateOptions, tmpls string) (io.Reader, error) {
-	t, err := template.New("").Funcs(fm).Parse(strings.TrimSpace(tmpls))
-	if err != nil {
+	if err := o.validate(); err != nil {
 		return nil, err
 	}
 
 	var buf bytes.Buffer
 
-	if err := t.Execute(&buf, obj); err != nil {
+	buf.WriteString("# File created by jamd\n# DO NOT EDIT\n\n")
+
+	if err := writeBlock(&buf, o.Name, o.params()); err != nil {
 		return nil, err
 	}
 
@@ -256,22 +418,47 @@ func writeConfig(w io.Writer, r io.Reader) error {
 
 type Wrapper func(io.Reader) (io.Reader, error)
 
+// Create writes the configuration of the jail into parent. ConfigDir is
+// set to parent, so that a Jail using createOpts finds and later removes
+// the files written here.
 func Create(_ context.Context, parent string, createOpts *CreateOptions) error {
-	pat := filepath.Join(parent, createOpts.Name+".conf")
+	opts := *createOpts
+	opts.ConfigDir = parent
 
-	configFile, err := os.OpenFile(pat, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	config, err := opts.buildConfig()
 	if err != nil {
 		return err
 	}
 
-	defer configFile.Close()
+	if opts.Mount != nil && len(opts.Mount.Entries) > 0 {
+		fstab, err := opts.buildFstab()
+		if err != nil {
+			return err
+		}
+
+		if err := createFile(opts.fstabFilePath(), fstab); err != nil {
+			return err
+		}
+	}
 
-	config, err := createOpts.buildConfig()
+	if err := createFile(opts.configFilePath(), config); err != nil {
+		return err
+	}
+
+	createOpts.ConfigDir = parent
+
+	return nil
+}
+
+func createFile(pat string, r io.Reader) error {
+	f, err := os.OpenFile(pat, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0o644)
 	if err != nil {
 		return err
 	}
 
-	if _, err = io.Copy(configFile, config); err != nil {
+	defer f.Close()
+
+	if _, err = io.Copy(f, r); err != nil {
 		return err
 	}
 
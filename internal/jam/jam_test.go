@@ -0,0 +1,379 @@
+package jam_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/edsonmichaque/jam/internal/jam"
+	"github.com/edsonmichaque/jam/internal/jam/jamtest"
+)
+
+// The epair of the jail named "web", named after the CRC-32 of its name.
+const (
+	hostIf = "jam15c93851a"
+	jailIf = "jam15c93851b"
+)
+
+type fixture struct {
+	dir    string
+	runner *jamtest.Runner
+	jail   *jam.Jail
+	leases *releaser
+}
+
+type releaser struct {
+	released []string
+}
+
+func (r *releaser) Release(name string) error {
+	r.released = append(r.released, name)
+	return nil
+}
+
+// newJail creates the configuration of a jail using every host-side
+// feature: rctl limits, a cpuset, a managed epair and pf port forwards.
+func newJail(t *testing.T) *fixture {
+	t.Helper()
+
+	dir := t.TempDir()
+	runner := new(jamtest.Runner)
+
+	opts := &jam.CreateOptions{
+		Name: "web",
+		Path: "/usr/jails/web",
+		VNet: &jam.VNetOptions{
+			Bridge: "bridge0",
+			Addr:   []string{"10.0.0.2/24"},
+		},
+		Limits: []jam.Limit{
+			{Resource: jam.ResourceMemoryUse, Action: jam.LimitDeny, Amount: 1 << 30},
+			{Resource: jam.ResourceMaxProc, Action: jam.LimitDeny, Amount: 100},
+		},
+		CPUSet:      &jam.CPUSetOptions{CPUs: jam.CPUList{0, 1, 2, 3}},
+		PortForward: []jam.PortForward{{Proto: "tcp", HostPort: 8080, JailPort: 80}},
+	}
+
+	if err := jam.Create(context.Background(), dir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fixture{dir: dir, runner: runner, leases: new(releaser)}
+
+	f.jail = &jam.Jail{
+		Name:   opts.Name,
+		Config: opts,
+		Runner: runner,
+		Firewall: &jam.PF{
+			Runner:    runner,
+			Path:      filepath.Join(dir, "jam.pf"),
+			Interface: "em0",
+		},
+		Leases: f.leases,
+	}
+
+	return f
+}
+
+func (f *fixture) conf() string {
+	return filepath.Join(f.dir, "web.conf")
+}
+
+// startCommands are run by a successful Start.
+func (f *fixture) startCommands() []string {
+	return []string{
+		"/sbin/ifconfig epair create",
+		"/sbin/ifconfig epair0a name " + hostIf,
+		"/sbin/ifconfig epair0b name " + jailIf,
+		"/sbin/ifconfig bridge0 addm " + hostIf,
+		"/sbin/ifconfig " + hostIf + " up",
+		"/usr/sbin/jail -f " + f.conf() + " -c web -i",
+		"/usr/bin/rctl -a jail:web:memoryuse:deny=1073741824",
+		"/usr/bin/rctl -a jail:web:maxproc:deny=100",
+		"/bin/cpuset -j 12 -l 0-3",
+		"/sbin/pfctl -a jam -nf " + filepath.Join(f.dir, ".jam.pf-") + "*",
+		"/sbin/pfctl -a jam -f " + filepath.Join(f.dir, "jam.pf"),
+	}
+}
+
+// teardownCommands are run by the rollback of a Start that failed before
+// pf rules were added, and by the Stop that follows.
+func (f *fixture) teardownCommands() []string {
+	return []string{
+		"/usr/sbin/jail -f " + f.conf() + " -r web",
+		"/usr/bin/rctl -r jail:web",
+		"/sbin/ifconfig " + hostIf + " destroy",
+	}
+}
+
+// expectGone scripts the failures of jail(8), rctl and ifconfig for a jail
+// that is already torn down.
+func (f *fixture) expectGone() {
+	f.runner.Expect("/usr/sbin/jail -f "+f.conf()+" -r", jamtest.Response{ExitCode: 1, Stderr: "jail: \"web\" not found\n"})
+	f.runner.Expect("/usr/bin/rctl -r", jamtest.Response{ExitCode: 1, Stderr: "rctl: failed to remove rule 'jail:web': No such process\n"})
+	f.runner.Expect("/sbin/ifconfig "+hostIf+" destroy", jamtest.Response{ExitCode: 1, Stderr: "ifconfig: interface " + hostIf + " does not exist\n"})
+}
+
+func (f *fixture) expectStart() {
+	f.runner.Expect("/sbin/ifconfig epair create", jamtest.Response{Stdout: "epair0a\n"})
+	f.runner.Expect("/usr/sbin/jail -f "+f.conf()+" -c", jamtest.Response{Stdout: "starting\n12\n"})
+}
+
+// checkCommands compares the recorded command lines with want, in which a
+// trailing "*" matches any suffix.
+func checkCommands(t *testing.T, r *jamtest.Runner, want []string) {
+	t.Helper()
+
+	got := r.Commands()
+
+	ok := len(got) == len(want)
+
+	for i := 0; ok && i < len(want); i++ {
+		if prefix, glob := strings.CutSuffix(want[i], "*"); glob {
+			ok = strings.HasPrefix(got[i], prefix)
+		} else {
+			ok = got[i] == want[i]
+		}
+	}
+
+	if !ok {
+		t.Errorf("commands:\n\t%s\nwant:\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+func TestStartStop(t *testing.T) {
+	f := newJail(t)
+	f.expectStart()
+
+	if err := f.jail.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.jail.State != jam.StateRunning || f.jail.ID != 12 {
+		t.Fatalf("State = %v, ID = %d, want running, 12", f.jail.State, f.jail.ID)
+	}
+
+	checkCommands(t, f.runner, f.startCommands())
+
+	rules, err := os.ReadFile(filepath.Join(f.dir, "jam.pf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "rdr pass on em0 inet proto tcp from any to (em0) port 8080 -> 10.0.0.2 port 80\n"; !strings.Contains(string(rules), want) {
+		t.Errorf("pf rules:\n%s\nwant a line %q", rules, want)
+	}
+
+	f.runner.Reset()
+
+	if err := f.jail.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.jail.State != jam.StateStopped || f.jail.ID != 0 {
+		t.Fatalf("State = %v, ID = %d, want stopped, 0", f.jail.State, f.jail.ID)
+	}
+
+	checkCommands(t, f.runner, []string{
+		"/usr/sbin/jail -f " + f.conf() + " -r web",
+		"/sbin/pfctl -a jam -nf " + filepath.Join(f.dir, ".jam.pf-") + "*",
+		"/sbin/pfctl -a jam -f " + filepath.Join(f.dir, "jam.pf"),
+		"/usr/bin/rctl -r jail:web",
+		"/sbin/ifconfig " + hostIf + " destroy",
+	})
+}
+
+func TestStartFailure(t *testing.T) {
+	f := newJail(t)
+	f.runner.Expect("/sbin/ifconfig epair create", jamtest.Response{Stdout: "epair0a\n"})
+	f.runner.Expect("/usr/sbin/jail -f "+f.conf()+" -c", jamtest.Response{ExitCode: 1, Stderr: "jail: web: mount.devfs: failed\n"})
+	f.expectGone()
+
+	err := f.jail.Start(context.Background())
+
+	var cmdErr *jam.CommandError
+	if !errors.As(err, &cmdErr) || !strings.Contains(err.Error(), "mount.devfs: failed") {
+		t.Fatalf("Start() error = %v, want a CommandError with stderr", err)
+	}
+
+	if f.jail.State != jam.StateFailed || f.jail.ID != 0 {
+		t.Fatalf("State = %v, ID = %d, want failed, 0", f.jail.State, f.jail.ID)
+	}
+
+	checkCommands(t, f.runner, append(f.startCommands()[:6], f.teardownCommands()...))
+}
+
+func TestStartTimeoutRemovesJail(t *testing.T) {
+	f := newJail(t)
+	f.runner.Expect("/sbin/ifconfig epair create", jamtest.Response{Stdout: "epair0a\n"})
+	// exec.start hangs after jail(8) created the jail.
+	f.runner.Expect("/usr/sbin/jail -f "+f.conf()+" -c", jamtest.Response{Err: context.DeadlineExceeded})
+	f.runner.Expect("/usr/bin/rctl -r", jamtest.Response{ExitCode: 1, Stderr: "rctl: failed to remove rule 'jail:web': No such process\n"})
+
+	if err := f.jail.Start(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Start() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if f.jail.State != jam.StateFailed || f.jail.ID != 0 {
+		t.Fatalf("State = %v, ID = %d, want failed, 0", f.jail.State, f.jail.ID)
+	}
+
+	checkCommands(t, f.runner, append(f.startCommands()[:6], f.teardownCommands()...))
+}
+
+func TestStartRollsBackHostSetup(t *testing.T) {
+	f := newJail(t)
+	f.expectStart()
+	f.runner.Expect("/bin/cpuset", jamtest.Response{ExitCode: 1})
+
+	if err := f.jail.Start(context.Background()); err == nil {
+		t.Fatal("Start() succeeded")
+	}
+
+	if f.jail.State != jam.StateFailed || f.jail.ID != 0 {
+		t.Fatalf("State = %v, ID = %d, want failed, 0", f.jail.State, f.jail.ID)
+	}
+
+	checkCommands(t, f.runner, append(f.startCommands()[:9], f.teardownCommands()...))
+}
+
+func TestStopRunsEveryStep(t *testing.T) {
+	f := newJail(t)
+	f.expectStart()
+
+	if err := f.jail.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f.runner.Reset()
+	f.runner.Expect("/sbin/pfctl", jamtest.Response{ExitCode: 1, Stderr: "pfctl: syntax error\n"})
+
+	err := f.jail.Stop(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "pfctl: syntax error") {
+		t.Fatalf("Stop() error = %v, want the pfctl failure", err)
+	}
+
+	if f.jail.State != jam.StateFailed {
+		t.Fatalf("State = %v, want failed", f.jail.State)
+	}
+
+	checkCommands(t, f.runner, []string{
+		"/usr/sbin/jail -f " + f.conf() + " -r web",
+		"/sbin/pfctl -a jam -nf " + filepath.Join(f.dir, ".jam.pf-") + "*",
+		"/usr/bin/rctl -r jail:web",
+		"/sbin/ifconfig " + hostIf + " destroy",
+	})
+}
+
+func TestRestartStopsFailedJail(t *testing.T) {
+	f := newJail(t)
+	f.expectStart()
+	f.runner.Expect("/bin/cpuset", jamtest.Response{ExitCode: 1})
+	// The rollback cannot remove the jail, which keeps its JID.
+	f.runner.Expect("/usr/sbin/jail -f "+f.conf()+" -r", jamtest.Response{ExitCode: 1, Stderr: "jail: web: Device busy\n"})
+
+	if err := f.jail.Start(context.Background()); err == nil {
+		t.Fatal("Start() succeeded")
+	}
+
+	if f.jail.State != jam.StateFailed || f.jail.ID != 12 {
+		t.Fatalf("State = %v, ID = %d, want failed, 12", f.jail.State, f.jail.ID)
+	}
+
+	// The rollback already removed the rules and the epair.
+	f.runner.Reset()
+	f.expectStart()
+	f.runner.Expect("/usr/bin/rctl -r", jamtest.Response{ExitCode: 1, Stderr: "rctl: failed to remove rule 'jail:web': No such process\n"})
+	f.runner.Expect("/sbin/ifconfig "+hostIf+" destroy", jamtest.Response{ExitCode: 1, Stderr: "ifconfig: interface " + hostIf + " does not exist\n"})
+
+	if err := f.jail.Restart(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.jail.State != jam.StateRunning {
+		t.Fatalf("State = %v, want running", f.jail.State)
+	}
+
+	checkCommands(t, f.runner, append(f.teardownCommands(), f.startCommands()...))
+}
+
+func TestRestartAfterRollback(t *testing.T) {
+	f := newJail(t)
+	f.expectStart()
+	f.runner.Expect("/bin/cpuset", jamtest.Response{ExitCode: 1})
+
+	if err := f.jail.Start(context.Background()); err == nil {
+		t.Fatal("Start() succeeded")
+	}
+
+	// Everything is gone, so each teardown step fails the way it does
+	// on a real host.
+	f.runner.Reset()
+	f.expectStart()
+	f.expectGone()
+
+	if err := f.jail.Restart(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.jail.State != jam.StateRunning {
+		t.Fatalf("State = %v, want running", f.jail.State)
+	}
+
+	checkCommands(t, f.runner, append(f.teardownCommands(), f.startCommands()...))
+}
+
+func TestRemove(t *testing.T) {
+	f := newJail(t)
+
+	if err := f.jail.Remove(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.jail.State != jam.StateRemoved {
+		t.Fatalf("State = %v, want removed", f.jail.State)
+	}
+
+	if _, err := os.Stat(f.conf()); !os.IsNotExist(err) {
+		t.Errorf("configuration left behind: %v", err)
+	}
+
+	if len(f.leases.released) != 1 || f.leases.released[0] != "web" {
+		t.Errorf("released %v, want [web]", f.leases.released)
+	}
+
+	if calls := f.runner.Calls(); len(calls) != 0 {
+		t.Errorf("Remove() ran %v", f.runner.Commands())
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	f := newJail(t)
+
+	var trErr *jam.TransitionError
+
+	if err := f.jail.Stop(context.Background()); !errors.As(err, &trErr) {
+		t.Fatalf("Stop() of a created jail: error = %v, want a TransitionError", err)
+	}
+
+	f.expectStart()
+
+	if err := f.jail.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.jail.Start(context.Background()); !errors.As(err, &trErr) {
+		t.Errorf("Start() of a running jail: error = %v, want a TransitionError", err)
+	}
+
+	if err := f.jail.Remove(context.Background()); !errors.As(err, &trErr) {
+		t.Errorf("Remove() of a running jail: error = %v, want a TransitionError", err)
+	}
+
+	if _, err := os.Stat(f.conf()); err != nil {
+		t.Errorf("configuration of a running jail removed: %v", err)
+	}
+}
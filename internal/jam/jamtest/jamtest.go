@@ -0,0 +1,158 @@
+// Package jamtest provides a recording jam.Runner for exercising jail
+// lifecycles without invoking jail(8).
+package jamtest
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/edsonmichaque/jam/internal/jam"
+)
+
+// Call is a command invocation recorded by Runner.
+type Call struct {
+	Path  string
+	Args  []string
+	Env   []string
+	Stdin []byte
+}
+
+// String returns the command line of the call.
+func (c Call) String() string {
+	return strings.Join(append([]string{c.Path}, c.Args...), " ")
+}
+
+// Response is the scripted outcome of a command.
+type Response struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Err      error
+}
+
+type expectation struct {
+	prefix    string
+	responses []Response
+}
+
+// Runner records every command it is asked to run and replies with scripted
+// responses. The zero value is ready to use and succeeds with no output.
+type Runner struct {
+	Default Response
+
+	mu           sync.Mutex
+	calls        []Call
+	expectations []*expectation
+}
+
+var _ jam.Runner = (*Runner)(nil)
+
+// Expect queues responses for commands whose command line, as returned by
+// Call.String, starts with prefix. Each matching call consumes one
+// response; once the queue is drained matching calls get Default.
+func (r *Runner) Expect(prefix string, responses ...Response) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expectations = append(r.expectations, &expectation{
+		prefix:    prefix,
+		responses: responses,
+	})
+}
+
+func (r *Runner) Run(ctx context.Context, cmd *jam.Command) error {
+	call := Call{
+		Path: cmd.Path,
+		Args: append([]string(nil), cmd.Args...),
+		Env:  append([]string(nil), cmd.Env...),
+	}
+
+	if cmd.Stdin != nil {
+		b, err := io.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+
+		call.Stdin = b
+	}
+
+	resp := r.record(call)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if cmd.Stdout != nil {
+		if _, err := io.WriteString(cmd.Stdout, resp.Stdout); err != nil {
+			return err
+		}
+	}
+
+	if cmd.Stderr != nil {
+		if _, err := io.WriteString(cmd.Stderr, resp.Stderr); err != nil {
+			return err
+		}
+	}
+
+	if resp.Err != nil {
+		return resp.Err
+	}
+
+	if resp.ExitCode != 0 {
+		return &jam.ExitError{Code: resp.ExitCode}
+	}
+
+	return nil
+}
+
+func (r *Runner) record(call Call) Response {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = append(r.calls, call)
+
+	line := call.String()
+	for _, e := range r.expectations {
+		if len(e.responses) == 0 || !strings.HasPrefix(line, e.prefix) {
+			continue
+		}
+
+		resp := e.responses[0]
+		e.responses = e.responses[1:]
+
+		return resp
+	}
+
+	return r.Default
+}
+
+// Calls returns the commands run so far, in order.
+func (r *Runner) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Call(nil), r.calls...)
+}
+
+// Commands returns the command lines of the calls run so far.
+func (r *Runner) Commands() []string {
+	calls := r.Calls()
+
+	lines := make([]string, 0, len(calls))
+	for _, c := range calls {
+		lines = append(lines, c.String())
+	}
+
+	return lines
+}
+
+// Reset forgets recorded calls and pending expectations.
+func (r *Runner) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls = nil
+	r.expectations = nil
+}
@@ -0,0 +1,146 @@
+package jam
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MountType is a file system type that can be mounted into a jail.
+type MountType string
+
+const (
+	MountNullFS    MountType = "nullfs"
+	MountTmpFS     MountType = "tmpfs"
+	MountProcFS    MountType = "procfs"
+	MountFdescFS   MountType = "fdescfs"
+	MountLinProcFS MountType = "linprocfs"
+)
+
+// MountEntry is a line of the jail's generated fstab. Target is relative to
+// the jail root; Source is the host directory for nullfs and is ignored for
+// the other types. Size limits tmpfs and accepts the k, m, g and t suffixes.
+type MountEntry struct {
+	Type     MountType `json:"Type"`
+	Source   string    `json:"Source,omitempty"`
+	Target   string    `json:"Target"`
+	ReadOnly bool      `json:"ReadOnly,omitempty"`
+	Size     string    `json:"Size,omitempty"`
+	Options  []string  `json:"Options,omitempty"`
+}
+
+func (e MountEntry) validate() error {
+	switch e.Type {
+	case MountNullFS:
+		if !filepath.IsAbs(e.Source) {
+			return fmt.Errorf("mount: nullfs source %q must be an absolute path", e.Source)
+		}
+	case MountTmpFS, MountProcFS, MountFdescFS, MountLinProcFS:
+	default:
+		return fmt.Errorf("mount: unsupported type %q", e.Type)
+	}
+
+	if !path.IsAbs(e.Target) || path.Clean(e.Target) == "/" {
+		return fmt.Errorf("mount: target %q must be an absolute path below the jail root", e.Target)
+	}
+
+	if e.Size != "" {
+		if e.Type != MountTmpFS {
+			return errors.New("mount: size is only supported by tmpfs")
+		}
+
+		if !validSize(e.Size) {
+			return fmt.Errorf("mount: invalid size %q", e.Size)
+		}
+	}
+
+	for _, opt := range e.Options {
+		if opt == "" || strings.ContainsAny(opt, ", \t\n#") {
+			return fmt.Errorf("mount: invalid option %q", opt)
+		}
+	}
+
+	return nil
+}
+
+func validSize(s string) bool {
+	digits := strings.TrimRight(s, "kKmMgGtT")
+	if digits == "" || len(s)-len(digits) > 1 {
+		return false
+	}
+
+	for i := 0; i < len(digits); i++ {
+		if digits[i] < '0' || digits[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fstab returns e as an fstab(5) line for a jail rooted at root.
+func (e MountEntry) fstab(root string) string {
+	source := e.Source
+
+	switch e.Type {
+	case MountTmpFS:
+		source = "tmpfs"
+	case MountProcFS:
+		source = "proc"
+	case MountFdescFS:
+		source = "fdesc"
+	case MountLinProcFS:
+		source = "linproc"
+	}
+
+	opts := []string{"rw"}
+	if e.ReadOnly {
+		opts[0] = "ro"
+	}
+
+	if e.Size != "" {
+		opts = append(opts, "size="+e.Size)
+	}
+
+	opts = append(opts, e.Options...)
+
+	fields := []string{
+		fstabEscape(source),
+		fstabEscape(filepath.Join(root, path.Clean(e.Target))),
+		string(e.Type),
+		strings.Join(opts, ","),
+		"0",
+		"0",
+	}
+
+	return strings.Join(fields, "\t")
+}
+
+func fstabEscape(s string) string {
+	return strings.NewReplacer(" ", `\040`, "\t", `\011`, "\n", `\012`, "\\", `\134`).Replace(s)
+}
+
+func (o CreateOptions) fstabFilePath() string {
+	return strings.TrimSuffix(o.configFilePath(), ".conf") + ".fstab"
+}
+
+func (o CreateOptions) buildFstab() (io.Reader, error) {
+	var buf bytes.Buffer
+
+	buf.WriteString("# File created by jamd\n# DO NOT EDIT\n")
+
+	for _, e := range o.Mount.Entries {
+		if err := e.validate(); err != nil {
+			return nil, err
+		}
+
+		buf.WriteString(e.fstab(o.Path))
+		buf.WriteByte('\n')
+	}
+
+	return &buf, nil
+}
@@ -0,0 +1,197 @@
+package jam
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildFstabGolden(t *testing.T) {
+	o := CreateOptions{
+		Name: "web",
+		Path: "/usr/jails/web",
+		Mount: &MountOptions{
+			Entries: []MountEntry{
+				{Type: MountNullFS, Source: "/usr/ports", Target: "/usr/ports", ReadOnly: true},
+				{Type: MountNullFS, Source: "/data/web site", Target: "/var/www"},
+				{Type: MountTmpFS, Target: "/tmp", Size: "512m", Options: []string{"mode=1777"}},
+				{Type: MountProcFS, Target: "/proc"},
+				{Type: MountFdescFS, Target: "/dev/fd"},
+				{Type: MountLinProcFS, Target: "/compat/linux/proc"},
+			},
+		},
+	}
+
+	r, err := o.buildFstab()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "web.fstab")
+
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("buildFstab() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMountEntryFstab(t *testing.T) {
+	tests := []struct {
+		name  string
+		root  string
+		entry MountEntry
+		want  string
+	}{
+		{
+			name:  "nullfs",
+			root:  "/usr/jails/web",
+			entry: MountEntry{Type: MountNullFS, Source: "/usr/src", Target: "/usr/src"},
+			want:  "/usr/src\t/usr/jails/web/usr/src\tnullfs\trw\t0\t0",
+		},
+		{
+			name:  "read only with options",
+			root:  "/usr/jails/web",
+			entry: MountEntry{Type: MountNullFS, Source: "/usr/src", Target: "/src", ReadOnly: true, Options: []string{"noexec"}},
+			want:  "/usr/src\t/usr/jails/web/src\tnullfs\tro,noexec\t0\t0",
+		},
+		{
+			name:  "spaces and tabs",
+			root:  "/usr/jails/web 1",
+			entry: MountEntry{Type: MountNullFS, Source: "/data/a b\tc", Target: "/mnt/d e"},
+			want:  `/data/a\040b\011c` + "\t" + `/usr/jails/web\0401/mnt/d\040e` + "\tnullfs\trw\t0\t0",
+		},
+		{
+			name:  "backslash",
+			root:  "/j",
+			entry: MountEntry{Type: MountNullFS, Source: `/a\b`, Target: "/b"},
+			want:  `/a\134b` + "\t/j/b\tnullfs\trw\t0\t0",
+		},
+		{
+			name:  "target cleaned below the root",
+			root:  "/usr/jails/web/",
+			entry: MountEntry{Type: MountTmpFS, Target: "/var/../tmp/", Size: "1g"},
+			want:  "tmpfs\t/usr/jails/web/tmp\ttmpfs\trw,size=1g\t0\t0",
+		},
+		{
+			name:  "dot dot stays below the root",
+			root:  "/usr/jails/web",
+			entry: MountEntry{Type: MountProcFS, Target: "/../../proc"},
+			want:  "proc\t/usr/jails/web/proc\tprocfs\trw\t0\t0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.entry.fstab(tt.root); got != tt.want {
+				t.Errorf("fstab() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMountEntryValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry MountEntry
+		err   string
+	}{
+		{
+			name:  "nullfs",
+			entry: MountEntry{Type: MountNullFS, Source: "/usr/src", Target: "/usr/src"},
+		},
+		{
+			name:  "tmpfs with size",
+			entry: MountEntry{Type: MountTmpFS, Target: "/tmp", Size: "64M"},
+		},
+		{
+			name:  "unknown type",
+			entry: MountEntry{Type: "ext4", Target: "/mnt"},
+			err:   `mount: unsupported type "ext4"`,
+		},
+		{
+			name:  "relative nullfs source",
+			entry: MountEntry{Type: MountNullFS, Source: "usr/src", Target: "/usr/src"},
+			err:   `mount: nullfs source "usr/src" must be an absolute path`,
+		},
+		{
+			name:  "relative target",
+			entry: MountEntry{Type: MountTmpFS, Target: "tmp"},
+			err:   `mount: target "tmp" must be an absolute path below the jail root`,
+		},
+		{
+			name:  "dot dot target",
+			entry: MountEntry{Type: MountTmpFS, Target: "../tmp"},
+			err:   `mount: target "../tmp" must be an absolute path below the jail root`,
+		},
+		{
+			name:  "jail root target",
+			entry: MountEntry{Type: MountTmpFS, Target: "/a/.."},
+			err:   `mount: target "/a/.." must be an absolute path below the jail root`,
+		},
+		{
+			name:  "size on nullfs",
+			entry: MountEntry{Type: MountNullFS, Source: "/a", Target: "/a", Size: "1g"},
+			err:   "mount: size is only supported by tmpfs",
+		},
+		{
+			name:  "tmpfs size with two suffixes",
+			entry: MountEntry{Type: MountTmpFS, Target: "/tmp", Size: "1mg"},
+			err:   `mount: invalid size "1mg"`,
+		},
+		{
+			name:  "tmpfs size without digits",
+			entry: MountEntry{Type: MountTmpFS, Target: "/tmp", Size: "g"},
+			err:   `mount: invalid size "g"`,
+		},
+		{
+			name:  "tmpfs size with a unit",
+			entry: MountEntry{Type: MountTmpFS, Target: "/tmp", Size: "1gb"},
+			err:   `mount: invalid size "1gb"`,
+		},
+		{
+			name:  "option with a comma",
+			entry: MountEntry{Type: MountTmpFS, Target: "/tmp", Options: []string{"mode=1777,nosuid"}},
+			err:   `mount: invalid option "mode=1777,nosuid"`,
+		},
+		{
+			name:  "empty option",
+			entry: MountEntry{Type: MountTmpFS, Target: "/tmp", Options: []string{""}},
+			err:   `mount: invalid option ""`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.entry.validate()
+
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("validate() error = %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("validate() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
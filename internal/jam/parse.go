@@ -0,0 +1,787 @@
+package jam
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxIncludeDepth bounds nested .include directives, which would otherwise
+// recurse forever on a file including itself.
+const maxIncludeDepth = 16
+
+// SyntaxError reports malformed jail.conf input. File is empty for input
+// given to ParseConfig.
+type SyntaxError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	file := e.File
+	if file == "" {
+		file = "jail.conf"
+	}
+
+	return fmt.Sprintf("%s:%d:%d: %s", file, e.Line, e.Column, e.Msg)
+}
+
+// ParseConfig reads jail.conf(5) syntax and returns the options of every jail
+// defined in it, in order of appearance. Global parameters and wildcard blocks
+// are merged into each jail, variables are expanded and "+=" appends are
+// applied. Parameters jam does not model are kept in CreateOptions.Params.
+//
+// Files named by .include directives are read in place of the directive; as
+// with jail(8), relative patterns are resolved against the working
+// directory.
+func ParseConfig(r io.Reader) ([]*CreateOptions, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(string(b), "")
+}
+
+// ParseConfigFile is ParseConfig for the named file. Relative .include
+// patterns are resolved against the directory of the including file.
+func ParseConfigFile(name string) ([]*CreateOptions, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(string(b), name)
+}
+
+func parseConfig(src, file string) ([]*CreateOptions, error) {
+	f, err := newParser(src, file).parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		names []string
+		seen  = make(map[string]bool)
+	)
+
+	for _, blk := range f.blocks {
+		if blk.wildcard() || seen[blk.name] {
+			continue
+		}
+
+		seen[blk.name] = true
+		names = append(names, blk.name)
+	}
+
+	opts := make([]*CreateOptions, 0, len(names))
+
+	for _, name := range names {
+		params, err := f.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+
+		o, err := fromParams(name, params)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, o)
+	}
+
+	return opts, nil
+}
+
+// part is a fragment of a value: either literal text or a variable
+// reference to be expanded once the jail is known.
+type part struct {
+	text string
+	ref  bool
+}
+
+type value []part
+
+type rawParam struct {
+	name   string
+	values []value
+	append bool
+	pos    position
+}
+
+type rawBlock struct {
+	name   string
+	params []rawParam
+}
+
+func (b *rawBlock) wildcard() bool {
+	return strings.Contains(b.name, "*")
+}
+
+func (b *rawBlock) matches(name string) bool {
+	if !b.wildcard() {
+		return b.name == name
+	}
+
+	ok, _ := path.Match(b.name, name)
+
+	return ok
+}
+
+type rawFile struct {
+	params []rawParam
+	blocks []*rawBlock
+}
+
+// resolve computes the effective parameters of the named jail: globals first,
+// then matching wildcard blocks, then the jail's own blocks.
+func (f *rawFile) resolve(name string) ([]param, error) {
+	var (
+		order  []string
+		values = map[string][]string{"name": {name}}
+		vars   = make(map[string]string)
+	)
+
+	apply := func(raw []rawParam) error {
+		for _, p := range raw {
+			expanded, err := expand(p, vars, values)
+			if err != nil {
+				return err
+			}
+
+			if strings.HasPrefix(p.name, "$") {
+				vars[p.name[1:]] = strings.Join(expanded, ",")
+				continue
+			}
+
+			if p.name == "name" {
+				continue
+			}
+
+			np := normalizeBool(param{name: p.name, values: expanded})
+
+			cur, ok := values[np.name]
+			if !ok {
+				order = append(order, np.name)
+			}
+
+			if p.append && cur != nil {
+				values[np.name] = append(cur, np.values...)
+			} else {
+				values[np.name] = np.values
+			}
+		}
+
+		return nil
+	}
+
+	if err := apply(f.params); err != nil {
+		return nil, err
+	}
+
+	for _, wildcard := range []bool{true, false} {
+		for _, blk := range f.blocks {
+			if blk.wildcard() == wildcard && blk.matches(name) {
+				if err := apply(blk.params); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	params := make([]param, 0, len(order))
+	for _, n := range order {
+		params = append(params, param{name: n, values: values[n]})
+	}
+
+	return params, nil
+}
+
+func expand(p rawParam, vars map[string]string, params map[string][]string) ([]string, error) {
+	if p.values == nil {
+		return nil, nil
+	}
+
+	out := make([]string, 0, len(p.values))
+
+	for _, v := range p.values {
+		var sb strings.Builder
+
+		for _, pt := range v {
+			if !pt.ref {
+				sb.WriteString(pt.text)
+				continue
+			}
+
+			if s, ok := vars[pt.text]; ok {
+				sb.WriteString(s)
+				continue
+			}
+
+			if s, ok := params[pt.text]; ok {
+				sb.WriteString(strings.Join(s, ","))
+				continue
+			}
+
+			return nil, p.pos.errorf("undefined variable %q", pt.text)
+		}
+
+		out = append(out, sb.String())
+	}
+
+	return out, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokEq
+	tokAppend
+	tokSemi
+	tokComma
+	tokLBrace
+	tokRBrace
+)
+
+// position locates a token in its file, for error messages.
+type position struct {
+	file         string
+	line, column int
+}
+
+func (p position) errorf(format string, args ...any) error {
+	return &SyntaxError{File: p.file, Line: p.line, Column: p.column, Msg: fmt.Sprintf(format, args...)}
+}
+
+type token struct {
+	kind  tokenKind
+	parts value
+	raw   string
+	pos   position
+}
+
+// literal returns the text of a word used as a name. Names are never
+// expanded, so a leading "$" is kept as written.
+func (t token) literal() string {
+	for _, p := range t.parts {
+		if p.ref {
+			return t.raw
+		}
+	}
+
+	var sb strings.Builder
+	for _, p := range t.parts {
+		sb.WriteString(p.text)
+	}
+
+	return sb.String()
+}
+
+type lexer struct {
+	src  string
+	file string
+	pos  int
+	line int
+	// bol is the offset of the first byte of the current line.
+	bol int
+}
+
+func (l *lexer) position() position {
+	return position{file: l.file, line: l.line, column: l.pos - l.bol + 1}
+}
+
+func (l *lexer) errorf(format string, args ...any) error {
+	return l.position().errorf(format, args...)
+}
+
+// newline records that the byte at offset i is a line break.
+func (l *lexer) newline(i int) {
+	l.line++
+	l.bol = i + 1
+}
+
+func (l *lexer) peek(off int) byte {
+	if l.pos+off >= len(l.src) {
+		return 0
+	}
+
+	return l.src[l.pos+off]
+}
+
+func (l *lexer) skip() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.newline(l.pos)
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#' || (c == '/' && l.peek(1) == '/'):
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '/' && l.peek(1) == '*':
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("unterminated comment")
+			}
+
+			for i := l.pos; i < l.pos+2+end; i++ {
+				if l.src[i] == '\n' {
+					l.newline(i)
+				}
+			}
+
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skip(); err != nil {
+		return token{}, err
+	}
+
+	tok := token{pos: l.position()}
+
+	if l.pos >= len(l.src) {
+		return tok, nil
+	}
+
+	single := map[byte]tokenKind{
+		'=': tokEq,
+		';': tokSemi,
+		',': tokComma,
+		'{': tokLBrace,
+		'}': tokRBrace,
+	}
+
+	c := l.src[l.pos]
+	if kind, ok := single[c]; ok {
+		l.pos++
+		tok.kind = kind
+		tok.raw = string(c)
+
+		return tok, nil
+	}
+
+	if c == '+' && l.peek(1) == '=' {
+		l.pos += 2
+		tok.kind = tokAppend
+		tok.raw = "+="
+
+		return tok, nil
+	}
+
+	start := l.pos
+
+	parts, err := l.word()
+	if err != nil {
+		return token{}, err
+	}
+
+	tok.kind = tokWord
+	tok.parts = parts
+	tok.raw = l.src[start:l.pos]
+
+	return tok, nil
+}
+
+// word reads adjacent quoted and unquoted fragments up to the next
+// delimiter.
+func (l *lexer) word() (value, error) {
+	var (
+		parts value
+		lit   strings.Builder
+	)
+
+	flush := func() {
+		if lit.Len() > 0 {
+			parts = append(parts, part{text: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	quote := byte(0)
+
+	for {
+		if l.pos >= len(l.src) {
+			if quote != 0 {
+				return nil, l.errorf("unterminated string")
+			}
+
+			break
+		}
+
+		c := l.src[l.pos]
+
+		if quote == 0 {
+			if strings.IndexByte(" \t\r\n;,={}#", c) >= 0 || (c == '+' && l.peek(1) == '=') {
+				break
+			}
+
+			if c == '"' || c == '\'' {
+				quote = c
+				l.pos++
+
+				// An empty string still yields a value.
+				if l.peek(0) == c {
+					parts = append(parts, part{})
+				}
+
+				continue
+			}
+		} else if c == quote {
+			quote = 0
+			l.pos++
+
+			continue
+		}
+
+		if c == '\n' {
+			l.newline(l.pos)
+		}
+
+		switch {
+		case quote == '\'':
+			lit.WriteByte(c)
+			l.pos++
+		case c == '\\':
+			e, err := l.escape()
+			if err != nil {
+				return nil, err
+			}
+
+			lit.WriteString(e)
+		case c == '$':
+			name, err := l.variable()
+			if err != nil {
+				return nil, err
+			}
+
+			flush()
+			parts = append(parts, part{text: name, ref: true})
+		default:
+			lit.WriteByte(c)
+			l.pos++
+		}
+	}
+
+	flush()
+
+	return parts, nil
+}
+
+func (l *lexer) escape() (string, error) {
+	l.pos++
+
+	if l.pos >= len(l.src) {
+		return "", l.errorf("trailing backslash")
+	}
+
+	c := l.src[l.pos]
+	l.pos++
+
+	switch c {
+	case 'n':
+		return "\n", nil
+	case 't':
+		return "\t", nil
+	case 'r':
+		return "\r", nil
+	case '\n':
+		l.newline(l.pos - 1)
+		return "", nil
+	default:
+		return string(c), nil
+	}
+}
+
+func (l *lexer) variable() (string, error) {
+	pos := l.position()
+	l.pos++
+
+	if l.peek(0) == '{' {
+		end := strings.IndexAny(l.src[l.pos:], "}\n")
+		if end < 0 || l.src[l.pos+end] != '}' {
+			return "", pos.errorf("unterminated variable reference")
+		}
+
+		name := l.src[l.pos+1 : l.pos+end]
+		l.pos += end + 1
+
+		if name == "" {
+			return "", pos.errorf("empty variable reference")
+		}
+
+		return name, nil
+	}
+
+	start := l.pos
+	for l.pos < len(l.src) && isVarChar(l.src[l.pos]) {
+		l.pos++
+	}
+
+	if l.pos == start {
+		return "", pos.errorf("empty variable reference")
+	}
+
+	return l.src[start:l.pos], nil
+}
+
+func isVarChar(c byte) bool {
+	return c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+type parser struct {
+	lex *lexer
+	tok token
+	// dir resolves relative .include patterns.
+	dir   string
+	depth int
+}
+
+func newParser(src, file string) *parser {
+	p := &parser{lex: &lexer{src: src, file: file, line: 1}}
+
+	if file != "" {
+		p.dir = filepath.Dir(file)
+	}
+
+	return p
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+
+	p.tok = tok
+
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return p.tok.pos.errorf(format, args...)
+}
+
+func (p *parser) parse() (*rawFile, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	f := new(rawFile)
+
+	for p.tok.kind != tokEOF {
+		if p.tok.kind != tokWord {
+			return nil, p.errorf("unexpected %q", p.tok.raw)
+		}
+
+		name := p.tok.literal()
+		pos := p.tok.pos
+
+		if name == ".include" {
+			if err := p.include(f); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		if strings.HasPrefix(name, ".") {
+			return nil, p.errorf("unsupported directive %q", name)
+		}
+
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind != tokLBrace {
+			param, err := p.param(name, pos)
+			if err != nil {
+				return nil, err
+			}
+
+			f.params = append(f.params, param)
+
+			continue
+		}
+
+		blk, err := p.block(name)
+		if err != nil {
+			return nil, err
+		}
+
+		f.blocks = append(f.blocks, blk)
+	}
+
+	return f, nil
+}
+
+// include reads the files matching the pattern of an .include directive
+// and adds what they define to f, as if written in place of the directive.
+func (p *parser) include(f *rawFile) error {
+	directive := p.tok
+
+	if err := p.advance(); err != nil {
+		return err
+	}
+
+	arg := p.tok
+
+	if arg.kind != tokWord {
+		return p.errorf("expected a path after .include")
+	}
+
+	for _, pt := range arg.parts {
+		if pt.ref {
+			return p.errorf("variables are not supported in .include")
+		}
+	}
+
+	if err := p.advance(); err != nil {
+		return err
+	}
+
+	if p.tok.kind != tokSemi {
+		return p.errorf("expected ';' after .include path")
+	}
+
+	if p.depth >= maxIncludeDepth {
+		return directive.pos.errorf(".include nested too deeply")
+	}
+
+	pattern := arg.literal()
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(p.dir, pattern)
+	}
+
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return arg.pos.errorf("invalid .include pattern %q", pattern)
+	}
+
+	// Only a pattern may match nothing.
+	if len(names) == 0 && !strings.ContainsAny(pattern, `*?[`) {
+		return arg.pos.errorf(".include: %s: no such file", pattern)
+	}
+
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return arg.pos.errorf(".include: %v", err)
+		}
+
+		sub := newParser(string(b), name)
+		sub.depth = p.depth + 1
+
+		inc, err := sub.parse()
+		if err != nil {
+			return err
+		}
+
+		f.params = append(f.params, inc.params...)
+		f.blocks = append(f.blocks, inc.blocks...)
+	}
+
+	return p.advance()
+}
+
+func (p *parser) block(name string) (*rawBlock, error) {
+	blk := &rawBlock{name: name}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	for p.tok.kind != tokRBrace {
+		if p.tok.kind != tokWord {
+			if p.tok.kind == tokEOF {
+				return nil, p.errorf("unterminated block %q", name)
+			}
+
+			return nil, p.errorf("unexpected %q", p.tok.raw)
+		}
+
+		pname := p.tok.literal()
+		pos := p.tok.pos
+
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+
+		if p.tok.kind == tokLBrace {
+			return nil, p.errorf("nested block %q", pname)
+		}
+
+		param, err := p.param(pname, pos)
+		if err != nil {
+			return nil, err
+		}
+
+		blk.params = append(blk.params, param)
+	}
+
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	return blk, nil
+}
+
+// param parses the remainder of a parameter whose name has already been
+// consumed.
+func (p *parser) param(name string, pos position) (rawParam, error) {
+	param := rawParam{name: name, pos: pos}
+
+	switch p.tok.kind {
+	case tokSemi:
+		if strings.HasPrefix(name, "$") {
+			return param, p.errorf("variable %s has no value", name)
+		}
+
+		return param, p.advance()
+	case tokEq:
+	case tokAppend:
+		param.append = true
+	default:
+		return param, p.errorf("expected '=' or ';' after %q", name)
+	}
+
+	for {
+		if err := p.advance(); err != nil {
+			return param, err
+		}
+
+		if p.tok.kind != tokWord {
+			return param, p.errorf("expected value for %q", name)
+		}
+
+		param.values = append(param.values, p.tok.parts)
+
+		if err := p.advance(); err != nil {
+			return param, err
+		}
+
+		switch p.tok.kind {
+		case tokComma:
+			continue
+		case tokSemi:
+			return param, p.advance()
+		default:
+			return param, p.errorf("expected ',' or ';' after value of %q", name)
+		}
+	}
+}
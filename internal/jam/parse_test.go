@@ -0,0 +1,196 @@
+package jam
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		err  string
+	}{
+		{
+			name: "unterminated block",
+			in:   "www {\n\tpath = /j;\n",
+			err:  `jail.conf:3:1: unterminated block "www"`,
+		},
+		{
+			name: "missing semicolon",
+			in:   "www {\n\tpath = /j\n}\n",
+			err:  `jail.conf:3:1: expected ',' or ';' after value of "path"`,
+		},
+		{
+			name: "missing value",
+			in:   "www {\n\tpath = ;\n}\n",
+			err:  `jail.conf:2:9: expected value for "path"`,
+		},
+		{
+			name: "missing equals sign",
+			in:   "persist\nwww { }\n",
+			err:  `jail.conf:2:1: expected '=' or ';' after "persist"`,
+		},
+		{
+			name: "nested block",
+			in:   "www {\n  inner {\n  }\n}\n",
+			err:  `jail.conf:2:9: nested block "inner"`,
+		},
+		{
+			name: "stray brace",
+			in:   "path = /j;\n}\n",
+			err:  `jail.conf:2:1: unexpected "}"`,
+		},
+		{
+			name: "unterminated string",
+			in:   "www {\n\thost.hostname = \"www;\n}\n",
+			err:  "jail.conf:4:1: unterminated string",
+		},
+		{
+			name: "unterminated comment",
+			in:   "www { }\n  /* comment\n",
+			err:  "jail.conf:2:3: unterminated comment",
+		},
+		{
+			name: "columns after a comment",
+			in:   "/* a\nb */ www {\n\tpath = ;\n}\n",
+			err:  `jail.conf:3:9: expected value for "path"`,
+		},
+		{
+			name: "undefined variable",
+			in:   "www {\n\tpath = \"/j/$dir\";\n}\n",
+			err:  `jail.conf:2:2: undefined variable "dir"`,
+		},
+		{
+			name: "variable without value",
+			in:   "$dir;\n",
+			err:  "jail.conf:1:5: variable $dir has no value",
+		},
+		{
+			name: "empty variable reference",
+			in:   "www {\n\tpath = ${};\n}\n",
+			err:  "jail.conf:2:9: empty variable reference",
+		},
+		{
+			name: "unterminated variable reference",
+			in:   "www {\n\tpath = \"${dir\";\n}\n",
+			err:  "jail.conf:2:10: unterminated variable reference",
+		},
+		{
+			name: "unsupported directive",
+			in:   ".foo \"bar\";\n",
+			err:  `jail.conf:1:1: unsupported directive ".foo"`,
+		},
+		{
+			name: "include without a path",
+			in:   ".include;\n",
+			err:  "jail.conf:1:9: expected a path after .include",
+		},
+		{
+			name: "include of a variable",
+			in:   ".include \"$dir/a.conf\";\n",
+			err:  "jail.conf:1:10: variables are not supported in .include",
+		},
+		{
+			name: "include of a missing file",
+			in:   "\n  .include \"/nonexistent/jail.conf\";\n",
+			err:  "jail.conf:2:12: .include: /nonexistent/jail.conf: no such file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig(strings.NewReader(tt.in))
+
+			var synErr *SyntaxError
+			if !errors.As(err, &synErr) {
+				t.Fatalf("ParseConfig() error = %v, want a SyntaxError", err)
+			}
+
+			if err.Error() != tt.err {
+				t.Errorf("ParseConfig() error = %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseConfigFileInclude(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"jail.conf": "exec.clean;\n" +
+			".include \"jail.d/*.conf\";\n" +
+			"www { path = /j/www; }\n",
+		"jail.d/a.conf": "db { path = /j/db; }\n",
+		"jail.d/b.conf": "$root = /j;\n.include \"../common\";\ncache { path = \"$root/cache\"; }\n",
+		"common":        "*.hostname = \"$name.example.org\";\n",
+		"jail.d/c.txt":  "ignored {\n",
+	}
+
+	for name, data := range files {
+		pat := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(pat), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(pat, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jails, err := ParseConfigFile(filepath.Join(dir, "jail.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ name, path string }{
+		{"db", "/j/db"},
+		{"cache", "/j/cache"},
+		{"www", "/j/www"},
+	}
+
+	if len(jails) != len(want) {
+		t.Fatalf("ParseConfigFile() returned %d jails, want %d", len(jails), len(want))
+	}
+
+	for i, w := range want {
+		o := jails[i]
+
+		if o.Name != w.name || o.Path != w.path {
+			t.Errorf("jail %d = %s at %s, want %s at %s", i, o.Name, o.Path, w.name, w.path)
+		}
+
+		if o.Exec == nil || !o.Exec.Clean {
+			t.Errorf("jail %s lost the global exec.clean", o.Name)
+		}
+	}
+
+	// Errors point into the included file.
+	bad := filepath.Join(dir, "jail.d", "z.conf")
+
+	if err := os.WriteFile(bad, []byte("z {\n\tpath = ;\n}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseConfigFile(filepath.Join(dir, "jail.conf"))
+	if want := bad + `:2:9: expected value for "path"`; err == nil || err.Error() != want {
+		t.Errorf("ParseConfigFile() error = %v, want %q", err, want)
+	}
+}
+
+func TestParseConfigFileIncludeLoop(t *testing.T) {
+	pat := filepath.Join(t.TempDir(), "jail.conf")
+
+	if err := os.WriteFile(pat, []byte(".include \"jail.conf\";\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ParseConfigFile(pat)
+	if want := pat + ":1:1: .include nested too deeply"; err == nil || err.Error() != want {
+		t.Errorf("ParseConfigFile() error = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,352 @@
+package jam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const pfctlCmd = "/sbin/pfctl"
+
+// PortForward redirects traffic arriving on the host to a jail. JailAddr
+// defaults to the jail's first IPv4 address and JailPort to HostPort.
+type PortForward struct {
+	Proto    string `json:"Proto"`
+	HostPort uint16 `json:"HostPort"`
+	JailAddr string `json:"JailAddr,omitempty"`
+	JailPort uint16 `json:"JailPort,omitempty"`
+}
+
+func (f PortForward) validate() error {
+	if f.Proto != "tcp" && f.Proto != "udp" {
+		return fmt.Errorf("port forward: invalid protocol %q", f.Proto)
+	}
+
+	if f.HostPort == 0 {
+		return errors.New("port forward: host port is required")
+	}
+
+	if f.JailAddr != "" {
+		if _, err := netip.ParseAddr(f.JailAddr); err != nil {
+			return fmt.Errorf("port forward: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// PF maintains a pf(4) anchor holding the nat and rdr rules of every
+// running jail. The main ruleset must reference it with nat-anchor and
+// rdr-anchor. Rules are written to Path, checked with pfctl -n and then
+// loaded into the anchor. The registered jails are kept in Path.json so
+// that a restarted jamd does not drop the rules of jails still running.
+type PF struct {
+	Runner    Runner
+	Anchor    string
+	Path      string
+	Interface string
+
+	mu    sync.Mutex
+	jails map[string]*CreateOptions
+}
+
+func (f *PF) anchor() string {
+	if f.Anchor == "" {
+		return "jam"
+	}
+
+	return f.Anchor
+}
+
+func (f *PF) runner() Runner {
+	if f.Runner == nil {
+		return DefaultRunner
+	}
+
+	return f.Runner
+}
+
+// Add registers the jail's rules and reloads the anchor.
+func (f *PF) Add(ctx context.Context, opts *CreateOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return err
+	}
+
+	prev, had := f.jails[opts.Name]
+	f.jails[opts.Name] = opts
+
+	if err := f.reload(ctx); err != nil {
+		if had {
+			f.jails[opts.Name] = prev
+		} else {
+			delete(f.jails, opts.Name)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Remove drops the jail's rules and reloads the anchor.
+func (f *PF) Remove(ctx context.Context, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return err
+	}
+
+	if _, ok := f.jails[name]; !ok {
+		return nil
+	}
+
+	delete(f.jails, name)
+
+	return f.reload(ctx)
+}
+
+// Rules returns the anchor contents for the registered jails.
+func (f *PF) Rules() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	return f.rules()
+}
+
+func (f *PF) statePath() string {
+	return f.Path + ".json"
+}
+
+// load reads the registered jails saved by a previous reload, once.
+func (f *PF) load() error {
+	if f.jails != nil {
+		return nil
+	}
+
+	if f.Path == "" {
+		return errors.New("pf: anchor file path is required")
+	}
+
+	jails := make(map[string]*CreateOptions)
+
+	b, err := os.ReadFile(f.statePath())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &jails); err != nil {
+			return fmt.Errorf("pf: %s: %w", f.statePath(), err)
+		}
+	}
+
+	f.jails = jails
+
+	return nil
+}
+
+func (f *PF) save() error {
+	b, err := json.Marshal(f.jails)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(f.statePath(), b)
+}
+
+func (f *PF) rules() ([]byte, error) {
+	if f.Interface == "" {
+		return nil, errors.New("pf: external interface is required")
+	}
+
+	names := make([]string, 0, len(f.jails))
+	for name := range f.jails {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+
+	buf.WriteString("# File created by jamd\n# DO NOT EDIT\n")
+
+	for _, name := range names {
+		opts := f.jails[name]
+		addrs := jailAddrs(opts)
+
+		fmt.Fprintf(&buf, "\n# %s\n", name)
+
+		for _, a := range addrs {
+			if a.Is4() {
+				fmt.Fprintf(&buf, "nat on %s inet from %s to any -> (%s)\n", f.Interface, a, f.Interface)
+			}
+		}
+
+		for _, fwd := range opts.PortForward {
+			addr, err := forwardAddr(fwd, addrs)
+			if err != nil {
+				return nil, fmt.Errorf("pf: jail %s: %w", name, err)
+			}
+
+			family := "inet"
+			if addr.Is6() {
+				family = "inet6"
+			}
+
+			port := fwd.JailPort
+			if port == 0 {
+				port = fwd.HostPort
+			}
+
+			fmt.Fprintf(&buf, "rdr pass on %s %s proto %s from any to (%s) port %d -> %s port %d\n",
+				f.Interface, family, fwd.Proto, f.Interface, fwd.HostPort, addr, port)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (f *PF) reload(ctx context.Context) error {
+	rules, err := f.rules()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := writeTemp(f.Path, rules)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	if err := f.pfctl(ctx, "-a", f.anchor(), "-nf", tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, f.Path); err != nil {
+		return err
+	}
+
+	if err := f.pfctl(ctx, "-a", f.anchor(), "-f", f.Path); err != nil {
+		return err
+	}
+
+	return f.save()
+}
+
+// writeTemp writes b to a new temporary file next to pat and returns its
+// name.
+func writeTemp(pat string, b []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(pat), "."+filepath.Base(pat)+"-*")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+func writeFileAtomic(pat string, b []byte) error {
+	tmp, err := writeTemp(pat, b)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	return os.Rename(tmp, pat)
+}
+
+func (f *PF) pfctl(ctx context.Context, args ...string) error {
+	var stderr bytes.Buffer
+
+	err := f.runner().Run(ctx, &Command{
+		Path:   pfctlCmd,
+		Args:   args,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		return &CommandError{
+			Path:   pfctlCmd,
+			Args:   args,
+			Stderr: stderr.String(),
+			Err:    err,
+		}
+	}
+
+	return nil
+}
+
+// jailAddrs returns the addresses configured for a jail, either through
+// ip4.addr and ip6.addr or on its managed VNET interface.
+func jailAddrs(opts *CreateOptions) []netip.Addr {
+	var (
+		addrs   []netip.Addr
+		entries []string
+	)
+
+	if opts.IPv4 != nil {
+		entries = append(entries, opts.IPv4.Addr...)
+	}
+
+	if opts.IPv6 != nil {
+		entries = append(entries, opts.IPv6.Addr...)
+	}
+
+	for _, s := range entries {
+		if _, prefix, err := ParseIPAddr(s); err == nil {
+			addrs = append(addrs, prefix.Addr())
+		}
+	}
+
+	if opts.VNet != nil {
+		for _, s := range opts.VNet.Addr {
+			if prefix, err := netip.ParsePrefix(s); err == nil {
+				addrs = append(addrs, prefix.Addr())
+			}
+		}
+	}
+
+	return addrs
+}
+
+func forwardAddr(fwd PortForward, addrs []netip.Addr) (netip.Addr, error) {
+	if fwd.JailAddr != "" {
+		return netip.ParseAddr(fwd.JailAddr)
+	}
+
+	for _, a := range addrs {
+		if a.Is4() {
+			return a, nil
+		}
+	}
+
+	return netip.Addr{}, fmt.Errorf("no IPv4 address to forward port %d to", fwd.HostPort)
+}
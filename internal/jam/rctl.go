@@ -0,0 +1,148 @@
+package jam
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const rctlCmd = "/usr/bin/rctl"
+
+// Resource is an rctl(8) resource name.
+type Resource string
+
+const (
+	ResourceMemoryUse  Resource = "memoryuse"
+	ResourceVMemoryUse Resource = "vmemoryuse"
+	ResourcePCPU       Resource = "pcpu"
+	ResourceMaxProc    Resource = "maxproc"
+	ResourceOpenFiles  Resource = "openfiles"
+	ResourceReadBPS    Resource = "readbps"
+	ResourceWriteBPS   Resource = "writebps"
+	ResourceReadIOPS   Resource = "readiops"
+	ResourceWriteIOPS  Resource = "writeiops"
+)
+
+// LimitAction is what rctl(8) does when a limit is exceeded: deny, log,
+// devctl, throttle or a signal such as sigterm.
+type LimitAction string
+
+const (
+	LimitDeny     LimitAction = "deny"
+	LimitLog      LimitAction = "log"
+	LimitDevctl   LimitAction = "devctl"
+	LimitThrottle LimitAction = "throttle"
+)
+
+var limitSignals = map[string]bool{
+	"sighup": true, "sigint": true, "sigquit": true, "sigkill": true,
+	"sigterm": true, "sigstop": true, "sigtstp": true, "sigxcpu": true,
+	"sigxfsz": true, "sigusr1": true, "sigusr2": true,
+}
+
+// Limit is a resource limit applied to the whole jail with rctl(8). Amount
+// is in bytes, bytes per second, operations per second, a count or, for
+// pcpu, a percentage of a single CPU.
+type Limit struct {
+	Resource Resource    `json:"Resource"`
+	Action   LimitAction `json:"Action"`
+	Amount   int64       `json:"Amount"`
+}
+
+func (l Limit) throttled() bool {
+	switch l.Resource {
+	case ResourceReadBPS, ResourceWriteBPS, ResourceReadIOPS, ResourceWriteIOPS:
+		return true
+	}
+
+	return false
+}
+
+func (l Limit) validate() error {
+	switch l.Resource {
+	case ResourceMemoryUse, ResourceVMemoryUse, ResourcePCPU, ResourceMaxProc, ResourceOpenFiles,
+		ResourceReadBPS, ResourceWriteBPS, ResourceReadIOPS, ResourceWriteIOPS:
+	default:
+		return fmt.Errorf("limit: unknown resource %q", l.Resource)
+	}
+
+	switch {
+	case l.Action == LimitLog, l.Action == LimitDevctl, limitSignals[string(l.Action)]:
+	case l.Action == LimitDeny && !l.throttled():
+	case l.Action == LimitThrottle && l.throttled():
+	default:
+		return fmt.Errorf("limit: action %q not supported for %s", l.Action, l.Resource)
+	}
+
+	if l.Amount < 0 {
+		return fmt.Errorf("limit: negative amount for %s", l.Resource)
+	}
+
+	return nil
+}
+
+func (l Limit) rule(name string) string {
+	return fmt.Sprintf("jail:%s:%s:%s=%d", name, l.Resource, l.Action, l.Amount)
+}
+
+func (j *Jail) applyLimits(ctx context.Context) error {
+	for _, l := range j.Config.Limits {
+		if err := j.runCommand(ctx, rctlCmd, []string{"-a", l.rule(j.Name)}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (j *Jail) removeLimits(ctx context.Context) error {
+	if len(j.Config.Limits) == 0 {
+		return nil
+	}
+
+	// rctl fails with ESRCH when no rule matches.
+	if err := j.runCommand(ctx, rctlCmd, []string{"-r", "jail:" + j.Name}); err != nil && !isGone(err, "No such process") {
+		return err
+	}
+
+	return nil
+}
+
+// Usage returns the jail's current resource consumption as reported by
+// rctl -u.
+func (j *Jail) Usage(ctx context.Context) (map[Resource]int64, error) {
+	if err := j.runCommand(ctx, rctlCmd, []string{"-u", "jail:" + j.Name}); err != nil {
+		return nil, err
+	}
+
+	return parseUsage(j.stdout.String())
+}
+
+// parseUsage reads the "resource=amount" lines printed by rctl -u.
+func parseUsage(out string) (map[Resource]int64, error) {
+	usage := make(map[Resource]int64)
+
+	s := bufio.NewScanner(strings.NewReader(out))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("rctl: malformed usage line %q", line)
+		}
+
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("rctl: %s: %w", k, err)
+		}
+
+		usage[Resource(k)] = n
+	}
+
+	return usage, nil
+}
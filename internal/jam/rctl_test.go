@@ -0,0 +1,122 @@
+package jam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLimitValidate(t *testing.T) {
+	tests := []struct {
+		limit Limit
+		err   string
+	}{
+		{limit: Limit{Resource: ResourceMemoryUse, Action: LimitDeny, Amount: 1 << 30}},
+		{limit: Limit{Resource: ResourcePCPU, Action: LimitLog, Amount: 50}},
+		{limit: Limit{Resource: ResourceMaxProc, Action: LimitDevctl, Amount: 100}},
+		{limit: Limit{Resource: ResourceOpenFiles, Action: "sigterm", Amount: 1024}},
+		{limit: Limit{Resource: ResourceReadBPS, Action: LimitThrottle, Amount: 1 << 20}},
+		{limit: Limit{Resource: ResourceWriteIOPS, Action: LimitLog}},
+		{
+			limit: Limit{Resource: "cputime", Action: LimitDeny, Amount: 1},
+			err:   `limit: unknown resource "cputime"`,
+		},
+		{
+			limit: Limit{Resource: ResourceMemoryUse, Action: "kill", Amount: 1},
+			err:   `limit: action "kill" not supported for memoryuse`,
+		},
+		{
+			limit: Limit{Resource: ResourceMemoryUse, Action: LimitThrottle, Amount: 1},
+			err:   `limit: action "throttle" not supported for memoryuse`,
+		},
+		{
+			limit: Limit{Resource: ResourceWriteBPS, Action: LimitDeny, Amount: 1},
+			err:   `limit: action "deny" not supported for writebps`,
+		},
+		{
+			limit: Limit{Resource: ResourceMaxProc, Action: "", Amount: 1},
+			err:   `limit: action "" not supported for maxproc`,
+		},
+		{
+			limit: Limit{Resource: ResourceMaxProc, Action: LimitDeny, Amount: -1},
+			err:   "limit: negative amount for maxproc",
+		},
+	}
+
+	for _, tt := range tests {
+		err := tt.limit.validate()
+
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%+v: validate() error = %v", tt.limit, err)
+			}
+
+			continue
+		}
+
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%+v: validate() error = %v, want %q", tt.limit, err, tt.err)
+		}
+	}
+}
+
+func TestParseUsage(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    map[Resource]int64
+		wantErr bool
+	}{
+		{
+			name: "usage",
+			out:  "cputime=12\nmemoryuse=1048576\nmaxproc=3\n",
+			want: map[Resource]int64{"cputime": 12, ResourceMemoryUse: 1048576, ResourceMaxProc: 3},
+		},
+		{
+			name: "blank lines and spaces",
+			out:  "\n  pcpu=4  \n\n",
+			want: map[Resource]int64{ResourcePCPU: 4},
+		},
+		{
+			name: "empty",
+			out:  "",
+			want: map[Resource]int64{},
+		},
+		{
+			name:    "missing equals sign",
+			out:     "memoryuse 1048576\n",
+			wantErr: true,
+		},
+		{
+			name:    "not a number",
+			out:     "memoryuse=1M\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty amount",
+			out:     "maxproc=\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUsage(tt.out)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseUsage() = %v, want an error", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUsage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package jam
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const jailCmd = "/usr/sbin/jail"
+
+// Command describes a single external program invocation.
+type Command struct {
+	Path   string
+	Args   []string
+	Env    []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Runner executes commands on behalf of a Jail. Implementations other than
+// ExecRunner allow the jail lifecycle to be driven without a FreeBSD host.
+type Runner interface {
+	Run(ctx context.Context, cmd *Command) error
+}
+
+// ExitError is returned by a Runner when a command exits with a non-zero
+// status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return "exit status " + strconv.Itoa(e.Code)
+}
+
+// CommandError reports a failed command along with what it wrote to stderr.
+type CommandError struct {
+	Path   string
+	Args   []string
+	Stderr string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	msg := strings.Join(append([]string{e.Path}, e.Args...), " ") + ": " + e.Err.Error()
+
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+
+	return msg
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// isGone reports whether err is a command failure whose stderr holds msg,
+// which teardown uses to recognise objects that no longer exist.
+func isGone(err error, msg string) bool {
+	var cmdErr *CommandError
+
+	return errors.As(err, &cmdErr) && strings.Contains(cmdErr.Stderr, msg)
+}
+
+// ExecRunner runs commands on the local host using os/exec.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, c *Command) error {
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	cmd.Env = c.Env
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return &ExitError{Code: exitErr.ExitCode()}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+var DefaultRunner Runner = ExecRunner{}
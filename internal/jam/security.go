@@ -0,0 +1,177 @@
+package jam
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// SysVMode selects how a jail's System V IPC namespaces are provided.
+type SysVMode string
+
+const (
+	SysVNew     SysVMode = "new"
+	SysVInherit SysVMode = "inherit"
+	SysVDisable SysVMode = "disable"
+)
+
+// SecurityOptions holds the parameters that restrict what a jail can see and
+// do. Nil and empty fields are not written, leaving the jail(8) default.
+type SecurityOptions struct {
+	SecureLevel   *int     `json:"SecureLevel,omitempty"`
+	EnforceStatFS *int     `json:"EnforceStatFS,omitempty"`
+	ChildrenMax   *int     `json:"ChildrenMax,omitempty"`
+	DevFSRuleset  *int     `json:"DevFSRuleset,omitempty"`
+	SysVMsg       SysVMode `json:"SysVMsg,omitempty"`
+	SysVSem       SysVMode `json:"SysVSem,omitempty"`
+	SysVShm       SysVMode `json:"SysVShm,omitempty"`
+	OSRelease     string   `json:"OSRelease,omitempty"`
+	OSRelDate     *int     `json:"OSRelDate,omitempty"`
+}
+
+// DefaultSecurityOptions returns the settings applied to jails created
+// without explicit SecurityOptions, or to the fields they leave unset: no schg or kernel tampering, only the
+// jail's own mounts visible, no nested jails, the stock devfsrules_jail
+// ruleset and no System V IPC.
+func DefaultSecurityOptions() *SecurityOptions {
+	intp := func(i int) *int { return &i }
+
+	return &SecurityOptions{
+		SecureLevel:   intp(2),
+		EnforceStatFS: intp(2),
+		ChildrenMax:   intp(0),
+		DevFSRuleset:  intp(4),
+		SysVMsg:       SysVDisable,
+		SysVSem:       SysVDisable,
+		SysVShm:       SysVDisable,
+	}
+}
+
+// withDefaults returns a copy of o whose unset fields are taken from
+// DefaultSecurityOptions.
+func (o *SecurityOptions) withDefaults() *SecurityOptions {
+	d := DefaultSecurityOptions()
+	if o == nil {
+		return d
+	}
+
+	s := *o
+
+	for i, f := range s.ints() {
+		if *f.value == nil {
+			*f.value = *d.ints()[i].value
+		}
+	}
+
+	for i, f := range s.modes() {
+		if *f.value == "" {
+			*f.value = *d.modes()[i].value
+		}
+	}
+
+	return &s
+}
+
+type intField struct {
+	name     string
+	field    string
+	value    **int
+	min, max int
+}
+
+func (o *SecurityOptions) ints() []intField {
+	return []intField{
+		{"securelevel", "SecureLevel", &o.SecureLevel, -1, 3},
+		{"enforce_statfs", "EnforceStatFS", &o.EnforceStatFS, 0, 2},
+		{"children.max", "ChildrenMax", &o.ChildrenMax, 0, math.MaxInt32},
+		{"devfs_ruleset", "DevFSRuleset", &o.DevFSRuleset, 0, math.MaxUint16},
+		{"osreldate", "OSRelDate", &o.OSRelDate, 1, math.MaxInt32},
+	}
+}
+
+type modeField struct {
+	name  string
+	field string
+	value *SysVMode
+}
+
+func (o *SecurityOptions) modes() []modeField {
+	return []modeField{
+		{"sysvmsg", "SysVMsg", &o.SysVMsg},
+		{"sysvsem", "SysVSem", &o.SysVSem},
+		{"sysvshm", "SysVShm", &o.SysVShm},
+	}
+}
+
+func (o *SecurityOptions) validate() error {
+	for _, f := range o.ints() {
+		if v := *f.value; v != nil && (*v < f.min || *v > f.max) {
+			return fmt.Errorf("%s: %d out of range [%d, %d]", f.name, *v, f.min, f.max)
+		}
+	}
+
+	for _, f := range o.modes() {
+		switch *f.value {
+		case "", SysVNew, SysVInherit, SysVDisable:
+		default:
+			return fmt.Errorf("%s: invalid mode %q", f.name, *f.value)
+		}
+	}
+
+	return nil
+}
+
+func (o *SecurityOptions) params() []param {
+	var ps []param
+
+	for _, f := range o.ints() {
+		if v := *f.value; v != nil {
+			ps = append(ps, param{name: f.name, values: []string{strconv.Itoa(*v)}})
+		}
+	}
+
+	for _, f := range o.modes() {
+		if *f.value != "" {
+			ps = append(ps, param{name: f.name, values: []string{string(*f.value)}})
+		}
+	}
+
+	if o.OSRelease != "" {
+		ps = append(ps, param{name: "osrelease", values: []string{o.OSRelease}})
+	}
+
+	return ps
+}
+
+// set stores p in the matching field, reporting whether p is a security
+// parameter.
+func (o *SecurityOptions) set(p param) (bool, error) {
+	v, ok := single(p)
+
+	if p.name == "osrelease" && ok {
+		o.OSRelease = v
+		return true, nil
+	}
+
+	for _, f := range o.ints() {
+		if f.name == p.name && ok {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return true, fmt.Errorf("%s: %w", p.name, err)
+			}
+
+			*f.value = &i
+
+			return true, nil
+		}
+	}
+
+	for _, f := range o.modes() {
+		if f.name == p.name && ok {
+			*f.value = SysVMode(v)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,92 @@
+package jam
+
+import (
+	"errors"
+	"fmt"
+)
+
+type State int
+
+const (
+	StateCreated State = iota
+	StateStarting
+	StateRunning
+	StateStopping
+	StateStopped
+	StateFailed
+	StateRemoved
+)
+
+var stateNames = map[State]string{
+	StateCreated:  "created",
+	StateStarting: "starting",
+	StateRunning:  "running",
+	StateStopping: "stopping",
+	StateStopped:  "stopped",
+	StateFailed:   "failed",
+	StateRemoved:  "removed",
+}
+
+var transitions = map[State][]State{
+	StateCreated:  {StateStarting, StateRemoved},
+	StateStarting: {StateRunning, StateFailed},
+	StateRunning:  {StateStopping},
+	StateStopping: {StateStopped, StateFailed},
+	StateStopped:  {StateStarting, StateRemoved},
+	StateFailed:   {StateStarting, StateStopping, StateRemoved},
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	if _, ok := stateNames[s]; !ok {
+		return nil, fmt.Errorf("invalid state %d", int(s))
+	}
+
+	return []byte(s.String()), nil
+}
+
+func (s *State) UnmarshalText(b []byte) error {
+	for state, name := range stateNames {
+		if name == string(b) {
+			*s = state
+			return nil
+		}
+	}
+
+	return fmt.Errorf("invalid state %q", b)
+}
+
+func (s State) canTransition(to State) bool {
+	for _, next := range transitions[s] {
+		if next == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// TransitionError is returned when a lifecycle operation is not allowed in
+// the jail's current state, e.g. stopping a stopped jail.
+type TransitionError struct {
+	Name string
+	From State
+	To   State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("jail %s: cannot move from %s to %s", e.Name, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrInvalidTransition
+}
@@ -0,0 +1,164 @@
+package jam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/netip"
+	"strings"
+)
+
+const ifconfigCmd = "/sbin/ifconfig"
+
+// VNetOptions configures a virtual network stack. When Bridge is set jam
+// owns an epair(4) for the jail: the host side is added to Bridge, the jail
+// side is handed over with vnet.interface and configured with Addr and
+// DefaultRouter when the jail starts. Otherwise Interface names an existing
+// interface to move into the jail.
+type VNetOptions struct {
+	Interface     string
+	Enable        bool
+	Bridge        string   `json:"Bridge,omitempty"`
+	Addr          []string `json:"Addr,omitempty"`
+	DefaultRouter []string `json:"DefaultRouter,omitempty"`
+}
+
+func (o *VNetOptions) managed() bool {
+	return o.Bridge != ""
+}
+
+func (o *VNetOptions) enabled() bool {
+	return o.Enable || o.managed()
+}
+
+// epair returns the names given to the host and jail ends of the jail's
+// epair. They are derived from the jail name so that they stay within
+// IFNAMSIZ and can be found again when the jail is stopped.
+func epair(name string) (string, string) {
+	base := fmt.Sprintf("jam%08x", crc32.ChecksumIEEE([]byte(name)))
+
+	return base + "a", base + "b"
+}
+
+func (o *VNetOptions) validate() error {
+	if !o.managed() {
+		if len(o.Addr) > 0 || len(o.DefaultRouter) > 0 {
+			return errors.New("vnet: addresses require a bridge")
+		}
+
+		return nil
+	}
+
+	if o.Interface != "" {
+		return errors.New("vnet: interface and bridge are mutually exclusive")
+	}
+
+	if strings.ContainsAny(o.Bridge, " \t\n/") {
+		return fmt.Errorf("vnet: invalid bridge %q", o.Bridge)
+	}
+
+	for _, s := range o.Addr {
+		if _, err := netip.ParsePrefix(s); err != nil {
+			return fmt.Errorf("vnet: invalid address %q", s)
+		}
+	}
+
+	for _, s := range o.DefaultRouter {
+		if _, err := netip.ParseAddr(s); err != nil {
+			return fmt.Errorf("vnet: invalid default router %q", s)
+		}
+	}
+
+	return nil
+}
+
+// startCommands returns the exec.start commands that configure the jail
+// side of a managed epair.
+func (o *VNetOptions) startCommands(name string) []string {
+	_, jailIf := epair(name)
+
+	var cmds []string
+
+	for _, s := range o.Addr {
+		prefix := netip.MustParsePrefix(s)
+
+		family := "inet"
+		if prefix.Addr().Is6() {
+			family = "inet6"
+		}
+
+		cmds = append(cmds, fmt.Sprintf("%s %s %s %s", ifconfigCmd, jailIf, family, prefix))
+	}
+
+	cmds = append(cmds, fmt.Sprintf("%s %s up", ifconfigCmd, jailIf))
+
+	for _, s := range o.DefaultRouter {
+		family := "-inet"
+		if netip.MustParseAddr(s).Is6() {
+			family = "-inet6"
+		}
+
+		cmds = append(cmds, fmt.Sprintf("/sbin/route add %s default %s", family, s))
+	}
+
+	return cmds
+}
+
+// createEpair creates the jail's epair and attaches its host side to the
+// bridge before jail(8) moves the other end into the jail.
+func (j *Jail) createEpair(ctx context.Context) error {
+	vnet := j.Config.VNet
+	if vnet == nil || !vnet.managed() {
+		return nil
+	}
+
+	if err := j.runCommand(ctx, ifconfigCmd, []string{"epair", "create"}); err != nil {
+		return err
+	}
+
+	created := strings.TrimSpace(j.stdout.String())
+	if !strings.HasSuffix(created, "a") {
+		return fmt.Errorf("vnet: unexpected epair name %q", created)
+	}
+
+	hostIf, jailIf := epair(j.Name)
+
+	steps := [][]string{
+		{created, "name", hostIf},
+		{strings.TrimSuffix(created, "a") + "b", "name", jailIf},
+		{vnet.Bridge, "addm", hostIf},
+		{hostIf, "up"},
+	}
+
+	current := created
+
+	for _, args := range steps {
+		if err := j.runCommand(ctx, ifconfigCmd, args); err != nil {
+			// Destroying the host end removes the whole pair.
+			_ = j.runCommand(ctx, ifconfigCmd, []string{current, "destroy"})
+			return err
+		}
+
+		if args[0] == created {
+			current = hostIf
+		}
+	}
+
+	return nil
+}
+
+func (j *Jail) destroyEpair(ctx context.Context) error {
+	vnet := j.Config.VNet
+	if vnet == nil || !vnet.managed() {
+		return nil
+	}
+
+	hostIf, _ := epair(j.Name)
+
+	if err := j.runCommand(ctx, ifconfigCmd, []string{hostIf, "destroy"}); err != nil && !isGone(err, "does not exist") {
+		return err
+	}
+
+	return nil
+}